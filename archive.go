@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// archiveSep separates an archive's own path from the member path inside it.
+const archiveSep = "!/"
+
+func isArchive(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// crawlArchive emits a record for every member of the archive at
+// archivePath that passes the same filters as a regular file. Size, mtime,
+// mode and, for tar, owner and the optional atime and ctime come from the
+// member headers. Inode and link count are left zero, as are any times and
+// owners the header lacks, which is what the filters see too. Content
+// based checks are skipped. Members count towards the directory summary of
+// the archive's directory, and logicalPath is the archive's logical path.
+func (pc *PosixCrawler) crawlArchive(archivePath string, logicalPath string, node *dirNode, sampled *bool) {
+	var err error
+	if strings.HasSuffix(strings.ToLower(archivePath), ".zip") {
+		err = pc.crawlZip(archivePath, logicalPath, node, sampled)
+	} else {
+		err = pc.crawlTar(archivePath, logicalPath, node, sampled)
+	}
+	if err != nil {
+		pc.reportError(newCrawlError("archive", archivePath, err))
+	}
+}
+
+func (pc *PosixCrawler) crawlZip(archivePath string, logicalPath string, node *dirNode, sampled *bool) error {
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if pc.cancelled() {
+			return nil
+		}
+		stat := memberStat(f.Mode(), int64(f.UncompressedSize64), 0, 0, f.Modified, time.Time{}, time.Time{})
+		pc.emitMember(node, sampled, archivePath, logicalPath, f.Name, f.Mode(), &stat)
+	}
+	return nil
+}
+
+func (pc *PosixCrawler) crawlTar(archivePath string, logicalPath string, node *dirNode, sampled *bool) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	name := strings.ToLower(archivePath)
+	if strings.HasSuffix(name, ".gz") || strings.HasSuffix(name, ".tgz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		if pc.cancelled() {
+			return nil
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mode := hdr.FileInfo().Mode()
+		stat := memberStat(mode, hdr.Size, hdr.Uid, hdr.Gid, hdr.ModTime, hdr.AccessTime, hdr.ChangeTime)
+		pc.emitMember(node, sampled, archivePath, logicalPath, hdr.Name, mode, &stat)
+	}
+}
+
+// memberStat fills in the parts of a stat an archive header carries.
+func memberStat(mode os.FileMode, size int64, uid int, gid int, mtime time.Time, atime time.Time, ctime time.Time) syscall.Stat_t {
+	stat := syscall.Stat_t{
+		Mode: uint32(mode.Perm()),
+		Size: size,
+		Uid:  uint32(uid),
+		Gid:  uint32(gid),
+	}
+	if mode&os.ModeSetuid != 0 {
+		stat.Mode |= syscall.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		stat.Mode |= syscall.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		stat.Mode |= syscall.S_ISVTX
+	}
+	for _, t := range []struct {
+		ts   *syscall.Timespec
+		time time.Time
+	}{{&stat.Mtim, mtime}, {&stat.Atim, atime}, {&stat.Ctim, ctime}} {
+		if !t.time.IsZero() {
+			*t.ts = syscall.NsecToTimespec(t.time.UnixNano())
+		}
+	}
+	return stat
+}
+
+func (pc *PosixCrawler) emitMember(node *dirNode, sampled *bool, archivePath string, logicalPath string, name string, mode os.FileMode, stat *syscall.Stat_t) {
+	atomic.AddInt64(&pc.stats.entries, 1)
+	name = strings.Trim(name, "/")
+	memberPath := archivePath + archiveSep + name
+	if pc.pattern != nil && !pc.pattern.MatchString(memberPath) {
+		pc.skip(skipRegexp)
+		return
+	}
+	risks, _, ok := pc.filterFile(memberPath, stat, sampled, true)
+	if !ok {
+		return
+	}
+
+	mtime := timespecToTime(stat.Mtim)
+	fileSignature := fmt.Sprintf("%s%d%d%d", memberPath, stat.Size, mtime.Unix(), mtime.Nanosecond())
+	info := &PosixInfo{
+		FilePath: memberPath,
+		Type:     fileTypeName(mode),
+		Mode:     fmt.Sprintf("%04o", stat.Mode&permBits),
+		Size:     stat.Size,
+		UID:      stat.Uid,
+		GID:      stat.Gid,
+		MTime:    mtime,
+		ID:       fmt.Sprintf("%x", md5.Sum([]byte(fileSignature))),
+		Risks:    risks,
+	}
+	if stat.Atim != (syscall.Timespec{}) {
+		info.ATime = timespecToTime(stat.Atim)
+	}
+	if stat.Ctim != (syscall.Timespec{}) && !pc.noCTime && pc.wants("ctime") {
+		ctime := timespecToTime(stat.Ctim)
+		info.CTime = &ctime
+	}
+	pc.fileRecord(info, stat, logicalPath+archiveSep+name, node)
+	pc.emit(node, info)
+}
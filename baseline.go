@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// loadBaseline reads the inode of every record in an earlier crawl's JSON
+// lines output, plain or -envelope, keyed by path. Records without an
+// inode, such as -names-only ones, are left out.
+func loadBaseline(baselineFile string) (map[string]uint64, error) {
+	f, err := os.Open(baselineFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type record struct {
+		FilePath string          `json:"file_path"`
+		INode    uint64          `json:"inode"`
+		Data     json.RawMessage `json:"data"`
+	}
+
+	inodes := make(map[string]uint64)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var rec record
+		err := json.Unmarshal(scanner.Bytes(), &rec)
+		if err == nil && len(rec.Data) > 0 {
+			err = json.Unmarshal(rec.Data, &rec)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", baselineFile, line, err)
+		}
+		if len(rec.FilePath) > 0 && rec.INode != 0 {
+			inodes[rec.FilePath] = rec.INode
+		}
+	}
+	return inodes, scanner.Err()
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// checkpointLog is an append-only list of directories whose records have
+// been written out, as `dir "<path>"`, and of directories whose whole
+// subtree has, as `tree "<path>"`. An entry follows the directory's records
+// through the output stage and is only logged once every sink has written
+// and flushed them, so a killed crawl loses no record; only a directory
+// written out right before the kill but not yet logged is emitted again on
+// restart. A directory that could not be listed is not logged, and neither
+// is any directory above it as a tree.
+type checkpointLog struct {
+	mu    sync.Mutex
+	f     *os.File
+	dirs  map[string]bool
+	trees map[string]bool
+}
+
+func openCheckpoint(checkpointFile string) (*checkpointLog, error) {
+	f, err := os.OpenFile(checkpointFile, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	cp := &checkpointLog{f: f, dirs: make(map[string]bool), trees: make(map[string]bool)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		parts := strings.SplitN(scanner.Text(), " ", 2)
+		dirPath, err := "", fmt.Errorf("malformed entry")
+		if len(parts) == 2 {
+			dirPath, err = strconv.Unquote(parts[1])
+		}
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("%s:%d: %v", checkpointFile, line, err)
+		}
+
+		switch parts[0] {
+		case "dir":
+			cp.dirs[dirPath] = true
+		case "tree":
+			cp.trees[dirPath] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cp, nil
+}
+
+// dirDone and treeDone only consult what earlier runs logged, which is
+// never written concurrently.
+func (cp *checkpointLog) dirDone(dirPath string) bool {
+	return cp.dirs[dirPath]
+}
+
+func (cp *checkpointLog) treeDone(dirPath string) bool {
+	return cp.trees[dirPath]
+}
+
+func (cp *checkpointLog) log(kind string, dirPath string) error {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	_, err := fmt.Fprintf(cp.f, "%s %s\n", kind, strconv.Quote(dirPath))
+	return err
+}
+
+func (cp *checkpointLog) Close() error {
+	return cp.f.Close()
+}
+
+// dirCommit stands in the record stream for a checkpoint entry. pending
+// counts the sinks that have not written the records ahead of it yet.
+type dirCommit struct {
+	kind    string
+	path    string
+	pending int32
+	failed  int32
+}
+
+// Flusher is implemented by sinks that buffer their writes. With
+// WithCheckpoint, Flush is called before a directory is logged as done.
+type Flusher interface {
+	Flush() error
+}
+
+// emit sends a record to the output, unless the directory it was found in
+// is being checkpointed, in which case it waits in the directory's batch.
+func (pc *PosixCrawler) emit(node *dirNode, info *PosixInfo) {
+	if node != nil && node.batched {
+		node.batch = append(node.batch, info)
+		return
+	}
+	pc.Outputs <- info
+}
+
+// flushBatch sends the directory's records followed by its checkpoint
+// entry. A directory abandoned by a cancelled crawl or whose listing failed
+// is neither sent nor logged, so a restart emits it in full.
+func (pc *PosixCrawler) flushBatch(node *dirNode) {
+	if pc.cancelled() || node.err != nil {
+		return
+	}
+	for _, info := range node.batch {
+		pc.Outputs <- info
+	}
+	node.batch = nil
+	if !node.skipFiles {
+		pc.Outputs <- &PosixInfo{commit: &dirCommit{kind: "dir", path: node.path}}
+	}
+}
+
+// commitDir queues a checkpoint entry behind the records sent to the sinks
+// so far. Where records are held back until the crawl is done, so is the
+// entry.
+func (pc *PosixCrawler) commitDir(info *PosixInfo) {
+	if pc.topSize > 0 || pc.sortBySize || pc.linkScope {
+		pc.heldCommits = append(pc.heldCommits, info)
+		return
+	}
+	pc.sendCommit(info)
+}
+
+func (pc *PosixCrawler) sendCommit(info *PosixInfo) {
+	info.commit.pending = int32(len(pc.sinkQueues))
+	for _, queue := range pc.sinkQueues {
+		queue <- info
+	}
+}
+
+// sinkCommitted is called by each sink once it wrote everything ahead of
+// commit; the last one logs the entry, unless any of them failed.
+func (pc *PosixCrawler) sinkCommitted(sink Sink, commit *dirCommit, failed bool) {
+	if flusher, ok := sink.(Flusher); ok && !failed {
+		if err := flusher.Flush(); err != nil {
+			pc.reportError(newCrawlError("write", "sink", err))
+			failed = true
+		}
+	}
+	if failed {
+		atomic.StoreInt32(&commit.failed, 1)
+	}
+	if atomic.AddInt32(&commit.pending, -1) > 0 || atomic.LoadInt32(&commit.failed) != 0 {
+		return
+	}
+	if err := pc.checkpoint.log(commit.kind, commit.path); err != nil {
+		pc.reportError(newCrawlError("checkpoint", pc.checkpointFile, err))
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// crawlRecords crawls root and returns the records in the order the sink
+// got them.
+func crawlRecords(t *testing.T, root string, opts ...Option) []*PosixInfo {
+	var mu sync.Mutex
+	var records []*PosixInfo
+	opts = append(opts, WithSink(SinkFunc(func(info *PosixInfo) error {
+		mu.Lock()
+		records = append(records, info)
+		mu.Unlock()
+		return nil
+	})))
+	if err := NewPosixCrawler(2, "", false, opts...).Crawl(root); err != nil {
+		t.Fatalf("crawl: %v", err)
+	}
+	return records
+}
+
+func crawlPaths(t *testing.T, root string, opts ...Option) []string {
+	var paths []string
+	for _, info := range crawlRecords(t, root, opts...) {
+		paths = append(paths, info.FilePath)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestCheckpointRestart(t *testing.T) {
+	root, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, name := range []string{"a/x", "a/b/y", "z"} {
+		filePath := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err := ioutil.WriteFile(filePath, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkpointFile := root + ".checkpoint"
+	defer os.Remove(checkpointFile)
+
+	paths := crawlPaths(t, root, WithCheckpoint(checkpointFile))
+	want := []string{filepath.Join(root, "a/b/y"), filepath.Join(root, "a/x"), filepath.Join(root, "z")}
+	if strings.Join(paths, ",") != strings.Join(want, ",") {
+		t.Fatalf("first crawl emitted %v, want %v", paths, want)
+	}
+
+	if paths := crawlPaths(t, root, WithCheckpoint(checkpointFile)); len(paths) != 0 {
+		t.Fatalf("restarted crawl emitted %v", paths)
+	}
+	if paths := crawlPaths(t, root, WithCheckpoint(checkpointFile), WithDirSummary()); len(paths) != 0 {
+		t.Fatalf("restarted crawl emitted summaries %v", paths)
+	}
+	log, err := ioutil.ReadFile(checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(log), "tree "+strconv.Quote(root)+"\n"); n != 1 {
+		t.Errorf("root logged as a tree %d times", n)
+	}
+}
+
+func TestCheckpointFailedListing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpointFile := filepath.Join(dir, "checkpoint")
+
+	pc := NewPosixCrawler(2, "", false, WithCheckpoint(checkpointFile))
+	if pc.checkpoint, err = openCheckpoint(checkpointFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parent is listed fine, its only child fails after a record
+	// was already batched.
+	parent := &dirNode{path: "/t", pending: 1, batched: true}
+	child := &dirNode{path: "/t/bad", parent: parent, pending: 1, batched: true}
+	parent.pending++
+	child.batch = []*PosixInfo{{FilePath: "/t/bad/g"}}
+	child.err = errors.New("permission denied")
+	parent.batch = []*PosixInfo{{FilePath: "/t/f"}}
+
+	pc.flushBatch(child)
+	pc.finishDir(child)
+	pc.flushBatch(parent)
+	pc.finishDir(parent)
+	pc.checkpoint.Close()
+	close(pc.Outputs)
+
+	var got []string
+	for info := range pc.Outputs {
+		if info.commit != nil {
+			got = append(got, info.commit.kind+" "+info.commit.path)
+		} else {
+			got = append(got, info.FilePath)
+		}
+	}
+	if want := []string{"/t/f", "dir /t"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("sent %v, want only the parent's record and dir entry %v", got, want)
+	}
+}
+
+func TestCheckpointAfterWrite(t *testing.T) {
+	root, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, name := range []string{"a/x", "a/y", "b/z"} {
+		filePath := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err := ioutil.WriteFile(filePath, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkpointFile := root + ".checkpoint"
+	defer os.Remove(checkpointFile)
+
+	// A record's directory must not be logged before the sink got it.
+	check := SinkFunc(func(info *PosixInfo) error {
+		log, err := ioutil.ReadFile(checkpointFile)
+		if err != nil {
+			return err
+		}
+		if entry := "dir " + strconv.Quote(filepath.Dir(info.FilePath)); strings.Contains(string(log), entry) {
+			t.Errorf("%s was logged before %s was written", entry, info.FilePath)
+		}
+		return nil
+	})
+	crawlPaths(t, root, WithCheckpoint(checkpointFile), WithSink(check))
+
+	log, err := ioutil.ReadFile(checkpointFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Count(string(log), "\n"); lines != 6 {
+		t.Errorf("checkpoint log has %d entries, want a dir and a tree entry per directory:\n%s", lines, log)
+	}
+}
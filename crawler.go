@@ -1,15 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
 	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,216 +31,3052 @@ import (
 )
 
 type PosixInfo struct {
-	FilePath string    `json:"file_path"`
-	INode    uint64    `json:"inode"`
-	Size     int64     `json:"size"`
-	UID      uint32    `json:"uid"`
-	GID      uint32    `json:"gid"`
-	MTime    time.Time `json:"mtime"`
-	CTime    time.Time `json:"ctime"`
-	ID       string    `json:"file_id"`
+	FilePath  string     `json:"file_path"`
+	Type      string     `json:"type"`
+	TypeChar  string     `json:"type_char"`
+	Dev       uint64     `json:"dev"`
+	INode     uint64     `json:"inode"`
+	Nlink     uint64     `json:"nlink"`
+	Mode      string     `json:"mode"`
+	Size      int64      `json:"size"`
+	SizeHuman string     `json:"size_human,omitempty"`
+	UID       uint32     `json:"uid"`
+	GID       uint32     `json:"gid"`
+	MTime     time.Time  `json:"mtime"`
+	CTime     *time.Time `json:"ctime,omitempty"`
+	ATime     time.Time  `json:"atime"`
+	ID        string     `json:"file_id"`
+	Entries   int        `json:"entries,omitempty"`
+	AgeBucket string     `json:"age_bucket,omitempty"`
+	Anomalies []string   `json:"time_anomalies,omitempty"`
+	Risks     []string   `json:"risks,omitempty"`
+	Readable  *bool      `json:"readable,omitempty"`
+	SHA256    string     `json:"sha256,omitempty"`
+	IsText    *bool      `json:"is_text,omitempty"`
+
+	HashListMatch bool  `json:"hash_list_match,omitempty"`
+	InodeChanged  bool  `json:"inode_changed,omitempty"`
+	ExternalLinks int64 `json:"external_links,omitempty"`
+
+	RawLinkTarget string     `json:"raw_link_target,omitempty"`
+	Target        *PosixInfo `json:"target,omitempty"`
+
+	Summary *DirSummary `json:"summary,omitempty"`
+
+	CaseCollisions []string `json:"case_collisions,omitempty"`
+
+	LogicalPath string `json:"logical_path,omitempty"`
+
+	RunID string `json:"run_id,omitempty"`
+
+	// commit is only set on the checkpoint entries passed along with the
+	// records, which are never written out.
+	commit *dirCommit
+}
+
+type DirSummary struct {
+	Files          int64 `json:"files"`
+	Bytes          int64 `json:"bytes"`
+	RecursiveFiles int64 `json:"recursive_files"`
+	RecursiveBytes int64 `json:"recursive_bytes"`
+}
+
+// dirNode tracks a directory until its whole subtree is crawled. pending
+// counts the directory's own listing plus every child directory that has
+// not completed yet; the last one to finish rolls the totals up.
+type dirNode struct {
+	summary DirSummary
+	path    string
+	logical string
+	parent  *dirNode
+	pending int32
+	err     error
+
+	// With WithCheckpoint, the directory's records are batched until its
+	// listing is done, and skipped when an earlier run already did it.
+	// failed is set once listing the directory or anything below it
+	// failed, so the subtree is never logged as done.
+	batched   bool
+	skipFiles bool
+	batch     []*PosixInfo
+	failed    int32
+}
+
+// DirDoneFunc is told how many file records a directory, or a directory's
+// whole subtree, produced, and the error listing the directory itself
+// failed with, if any. It is called from the crawl workers concurrently.
+type DirDoneFunc func(dir string, fileCount int, err error)
+
+// dirTask is a directory waiting to be crawled. path is where it really
+// lives, logical is the path it was reached by through followed symlinks.
+type dirTask struct {
+	path    string
+	logical string
+	depth   int
+	parent  *dirNode
+}
+
+type PathMode int
+
+const (
+	PathPhysical PathMode = iota
+	PathLogical
+	PathBoth
+)
+
+// TimeField selects the timestamp the time based filters and age buckets
+// compare against.
+type TimeField int
+
+const (
+	TimeMTime TimeField = iota
+	TimeATime
+	TimeCTime
+)
+
+func (pc *PosixCrawler) newPosixInfo(filePath string, fileType string, stat *syscall.Stat_t) *PosixInfo {
+	info := &PosixInfo{
+		FilePath: filePath,
+		Type:     fileType,
+		Dev:      uint64(stat.Dev),
+		INode:    stat.Ino,
+		Nlink:    uint64(stat.Nlink),
+		Mode:     fmt.Sprintf("%04o", stat.Mode&permBits),
+		Size:     stat.Size,
+		UID:      stat.Uid,
+		GID:      stat.Gid,
+		MTime:    timespecToTime(stat.Mtim),
+		ATime:    timespecToTime(stat.Atim),
+	}
+	if pc.wants("file_id") {
+		fileSignature := fmt.Sprintf("%s%d%d%d%d", filePath, stat.Ino, stat.Size, stat.Mtim.Sec, stat.Mtim.Nsec)
+		info.ID = fmt.Sprintf("%x", md5.Sum([]byte(fileSignature)))
+	}
+	if !pc.noCTime && pc.wants("ctime") {
+		ctime := timespecToTime(stat.Ctim)
+		info.CTime = &ctime
+	}
+	return info
+}
+
+const permBits = 07777
+
+type nameInfo struct {
+	FilePath string `json:"file_path"`
+	Type     string `json:"type"`
+}
+
+// collisionInfo is written for a case_collision record, which has no
+// metadata of its own: file_path is the directory and case_collisions the
+// paths of its entries whose names only differ in case.
+type collisionInfo struct {
+	FilePath       string   `json:"file_path"`
+	Type           string   `json:"type"`
+	CaseCollisions []string `json:"case_collisions"`
+	LogicalPath    string   `json:"logical_path,omitempty"`
+	RunID          string   `json:"run_id,omitempty"`
+}
+
+// envelope wraps every JSON record under -envelope so file, dir, error and
+// summary records can be told apart by Type alone.
+type envelope struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+type errorRecord struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Kind  string `json:"kind"`
+	Error string `json:"error"`
+}
+
+type summaryRecord struct {
+	RunID   string           `json:"run_id"`
+	Entries int64            `json:"entries"`
+	Emitted int64            `json:"emitted"`
+	Skipped map[string]int64 `json:"skipped,omitempty"`
+	Errors  int              `json:"errors"`
+
+	ManifestHash string `json:"manifest_hash,omitempty"`
+}
+
+func fileTypeName(mode os.FileMode) string {
+	switch {
+	case mode.IsRegular():
+		return "file"
+	case mode.IsDir():
+		return "dir"
+	case mode&os.ModeSymlink != 0:
+		return "symlink"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeCharDevice != 0:
+		return "char"
+	case mode&os.ModeDevice != 0:
+		return "block"
+	}
+	return "other"
+}
+
+// typeChars are the ls -l type characters for the fileTypeName names.
+var typeChars = map[string]string{
+	"file":    "-",
+	"dir":     "d",
+	"symlink": "l",
+	"socket":  "s",
+	"fifo":    "p",
+	"char":    "c",
+	"block":   "b",
+}
+
+func typeChar(fileType string) string {
+	if c, ok := typeChars[fileType]; ok {
+		return c
+	}
+	return "?"
+}
+
+func timespecToTime(ts syscall.Timespec) time.Time {
+	return time.Unix(int64(ts.Sec), int64(ts.Nsec)).UTC()
+}
+
+type ErrorKind int
+
+const (
+	Other ErrorKind = iota
+	PermissionDenied
+	NotFound
+	TooManyOpenFiles
+	Loop
+	Timeout
+)
+
+var errorKindNames = [...]string{
+	Other:            "other",
+	PermissionDenied: "permission_denied",
+	NotFound:         "not_found",
+	TooManyOpenFiles: "too_many_open_files",
+	Loop:             "loop",
+	Timeout:          "timeout",
+}
+
+func (k ErrorKind) String() string {
+	if k < 0 || int(k) >= len(errorKindNames) {
+		return errorKindNames[Other]
+	}
+	return errorKindNames[k]
+}
+
+var errCircularSymlink = errors.New("circular symlink")
+
+var ErrTooManyErrors = errors.New("too many errors")
+
+var ErrNoResults = errors.New("no records emitted")
+
+type CrawlError struct {
+	Op   string
+	Path string
+	Kind ErrorKind
+	Err  error
+}
+
+// newCrawlError takes op and path from err itself when it is an
+// *os.PathError, so the message reads the same as the underlying error.
+func newCrawlError(op string, path string, err error) *CrawlError {
+	if crawlErr, ok := err.(*CrawlError); ok {
+		return crawlErr
+	}
+	if pathErr, ok := err.(*os.PathError); ok {
+		op, path, err = pathErr.Op, pathErr.Path, pathErr.Err
+	}
+
+	return &CrawlError{
+		Op:   op,
+		Path: path,
+		Kind: errorKind(err),
+		Err:  err,
+	}
+}
+
+func (e *CrawlError) Error() string {
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *CrawlError) Unwrap() error {
+	return e.Err
+}
+
+func errorKind(err error) ErrorKind {
+	if errors.Is(err, errCircularSymlink) {
+		return Loop
+	}
+
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		if os.IsTimeout(err) {
+			return Timeout
+		}
+		return Other
+	}
+
+	switch errno {
+	case syscall.EACCES, syscall.EPERM:
+		return PermissionDenied
+	case syscall.ENOENT, syscall.ENOTDIR:
+		return NotFound
+	case syscall.EMFILE, syscall.ENFILE:
+		return TooManyOpenFiles
+	case syscall.ELOOP:
+		return Loop
+	case syscall.ETIMEDOUT:
+		return Timeout
+	}
+	return Other
+}
+
+type CrawlErrors []*CrawlError
+
+func (errs CrawlErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (errs CrawlErrors) Unwrap() []error {
+	unwrapped := make([]error, len(errs))
+	for i, err := range errs {
+		unwrapped[i] = err
+	}
+	return unwrapped
+}
+
+type skipReason int
+
+const (
+	skipRegexp skipReason = iota
+	skipExpectMode
+	skipDangerous
+	skipModifiedAfter
+	skipOlderThan
+	skipSample
+	skipOtherFS
+	skipMaxDepth
+	skipMaxDirs
+	skipHashList
+	skipInodeChanged
+	skipMaxPerOwner
+	skipMarker
+	numSkipReasons
+)
+
+var skipReasonNames = [numSkipReasons]string{
+	skipRegexp:        "regexp",
+	skipExpectMode:    "expect-mode",
+	skipDangerous:     "find-dangerous",
+	skipModifiedAfter: "modified-after",
+	skipOlderThan:     "older-than",
+	skipSample:        "sample-per-dir",
+	skipOtherFS:       "one-fs",
+	skipMaxDepth:      "max-depth",
+	skipMaxDirs:       "max-dirs",
+	skipHashList:      "hash-list",
+	skipInodeChanged:  "inode-changed",
+	skipMaxPerOwner:   "max-per-owner",
+	skipMarker:        "skip-marker",
+}
+
+type crawlStats struct {
+	entries int64
+	emitted int64
+	skipped [numSkipReasons]int64
+
+	// Cumulative nanoseconds over all workers, only kept with
+	// WithPhaseTiming.
+	readDirTime int64
+	statTime    int64
+	outputTime  int64
+
+	// longestPath is only touched by the output goroutine.
+	longestPath string
+}
+
+type PosixCrawler struct {
+	SubDirs        chan string
+	Outputs        chan *PosixInfo
+	Error          chan error
+	wg             sync.WaitGroup
+	concLimit      chan bool
+	pattern        *regexp.Regexp
+	followSymlink  bool
+	modifiedAfter  time.Time
+	largeDirs      int
+	caseCollisions bool
+	followRoot     bool
+	ageBuckets     []ageBucket
+	depthLimits    []depthLimit
+	topSize        int
+	anomalies      bool
+	anomalyGap     time.Duration
+	checkMode      bool
+	expectMode     uint32
+	namesOnly      bool
+	symlinkInfo    bool
+	olderThan      time.Duration
+	timeField      TimeField
+	dirSummary     bool
+	transforms     []func(string) string
+	dangerousOnly  bool
+	sensitive      []string
+	stats          crawlStats
+	sinks          []Sink
+	sinkBuffer     int
+	sinkQueues     []chan *PosixInfo
+	jsonSinks      []*jsonSink
+	envelope       bool
+	samplePerDir   bool
+	maxPerOwner    int64
+	ownerCounts    sync.Map
+	runID          string
+	pathMode       PathMode
+	noCTime        bool
+	intoArchives   bool
+	checkReadable  bool
+	classifyText   bool
+	textQueue      chan textJob
+	oneFS          bool
+	rootDev        uint64
+	maxDepth       int
+	maxDirs        int64
+	skipMarker     string
+	dirCount       int64
+	maxErrors      int64
+	errCount       int64
+	quit           chan bool
+	quitOnce       sync.Once
+	cancelErr      error
+	ran            bool
+	generatedID    bool
+	rootPath       string
+	manifestHash   bool
+	fields         map[string]bool
+	projection     []projectedField
+	statFiles      bool
+	fullMatch      bool
+	phaseTiming    bool
+	humanSizes     bool
+	requireResult  bool
+	baseline       map[string]uint64
+	readdirBatch   int
+	linkScope      bool
+	checkpointFile string
+	checkpoint     *checkpointLog
+	linkMu         sync.Mutex
+	linkPaths      map[inodeKey]map[string]bool
+	heldLinks      []*PosixInfo
+	heldCommits    []*PosixInfo
+	changedOnly    bool
+	binarySizes    bool
+	discovery      gate
+	output         gate
+	workWindow     bool
+	windowStart    time.Duration
+	windowEnd      time.Duration
+	hashFiles      bool
+	hashList       map[string]bool
+	hashListOnly   bool
+	sortBySize     bool
+	sortBudget     int64
+	dirDone        DirDoneFunc
+	subtreeDone    DirDoneFunc
+	manifest       [sha256.Size]byte
+	startTime      time.Time
+}
+
+// Sink receives every emitted record. Each sink is fed from its own
+// buffered queue by its own goroutine, so a slow sink only holds up the
+// others once its queue is full. Records are shared between sinks and
+// must not be modified.
+type Sink interface {
+	Write(info *PosixInfo) error
+}
+
+type SinkFunc func(info *PosixInfo) error
+
+func (fn SinkFunc) Write(info *PosixInfo) error {
+	return fn(info)
+}
+
+type jsonSink struct {
+	pc *PosixCrawler
+	w  io.Writer
+}
+
+func (s *jsonSink) Write(info *PosixInfo) error {
+	out := s.pc.marshal(info)
+	_, err := s.w.Write(append(out, '\n'))
+	return err
+}
+
+// Flush flushes w when it buffers, e.g. a bufio.Writer.
+func (s *jsonSink) Flush() error {
+	if flusher, ok := s.w.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (s *jsonSink) writeEnvelope(recordType string, data interface{}) error {
+	out, _ := json.Marshal(envelope{Type: recordType, Data: data})
+	_, err := s.w.Write(append(out, '\n'))
+	return err
+}
+
+type depthLimit struct {
+	minDepth  int
+	maxDepth  int
+	concLimit chan bool
+}
+
+type ageBucket struct {
+	upper time.Duration
+	label string
+}
+
+type Option func(*PosixCrawler)
+
+// WithLargeDirs switches the crawler to only emit directory records for
+// directories holding at least n entries.
+func WithLargeDirs(n int) Option {
+	return func(pc *PosixCrawler) {
+		pc.largeDirs = n
+	}
+}
+
+// WithCaseCollisions switches the crawler to only emit a case_collision
+// record for each set of entries in a directory whose names only differ in
+// case, with the directory as file_path and the entries' paths as
+// case_collisions.
+func WithCaseCollisions() Option {
+	return func(pc *PosixCrawler) {
+		pc.caseCollisions = true
+	}
+}
+
+func WithModifiedAfter(t time.Time) Option {
+	return func(pc *PosixCrawler) {
+		pc.modifiedAfter = t
+	}
+}
+
+// WithFollowRootOnly resolves a symlinked root once and then crawls the
+// tree without following any symlinks inside it.
+func WithFollowRootOnly() Option {
+	return func(pc *PosixCrawler) {
+		pc.followRoot = true
+		pc.followSymlink = false
+	}
+}
+
+// WithAgeBuckets labels every file with the age range its MTime falls in,
+// measured from the crawl start time. The bounds split ages into
+// len(bounds)+1 buckets, e.g. 7d,30d gives "0-7d", "7d-30d" and "30d+".
+func WithAgeBuckets(bounds ...time.Duration) Option {
+	return func(pc *PosixCrawler) {
+		sorted := append([]time.Duration(nil), bounds...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		pc.ageBuckets = nil
+		lower := "0"
+		for _, bound := range sorted {
+			upper := formatAge(bound)
+			pc.ageBuckets = append(pc.ageBuckets, ageBucket{upper: bound, label: lower + "-" + upper})
+			lower = upper
+		}
+		if len(sorted) > 0 {
+			pc.ageBuckets = append(pc.ageBuckets, ageBucket{upper: -1, label: lower + "+"})
+		}
+	}
+}
+
+// WithDepthLimit caps the number of directories crawled concurrently at
+// depths minDepth through maxDepth, on top of the overall concurrency.
+// A negative maxDepth leaves the range open ended. When ranges overlap the
+// first one registered applies.
+func WithDepthLimit(minDepth int, maxDepth int, conc int) Option {
+	return func(pc *PosixCrawler) {
+		pc.depthLimits = append(pc.depthLimits, depthLimit{
+			minDepth:  minDepth,
+			maxDepth:  maxDepth,
+			concLimit: make(chan bool, conc),
+		})
+	}
+}
+
+// WithTopSize only emits the n largest files, in descending size order,
+// once the crawl has finished.
+func WithTopSize(n int) Option {
+	return func(pc *PosixCrawler) {
+		pc.topSize = n
+	}
+}
+
+// WithTimestampAnomalies marks records whose timestamps are inconsistent
+// with normal file system behaviour. A positive gap also flags files whose
+// MTime is more than gap older than their CTime.
+func WithTimestampAnomalies(gap time.Duration) Option {
+	return func(pc *PosixCrawler) {
+		pc.anomalies = true
+		pc.anomalyGap = gap
+	}
+}
+
+// WithExpectMode only emits files whose permission bits, including
+// setuid, setgid and sticky, differ from mode.
+func WithExpectMode(mode uint32) Option {
+	return func(pc *PosixCrawler) {
+		pc.checkMode = true
+		pc.expectMode = mode & permBits
+	}
+}
+
+// WithNamesOnly lists every entry with just its path and the type reported
+// by the directory entry, without stat'ing anything or following symlinks.
+func WithNamesOnly() Option {
+	return func(pc *PosixCrawler) {
+		pc.namesOnly = true
+	}
+}
+
+// WithSymlinkRecords stops following symlinks and emits a record for each
+// one instead, carrying the link's own lstat metadata, its raw target and,
+// when the target exists, the target's metadata.
+func WithSymlinkRecords() Option {
+	return func(pc *PosixCrawler) {
+		pc.symlinkInfo = true
+		pc.followSymlink = false
+	}
+}
+
+// WithOlderThan only emits files whose filter time is more than age before
+// the crawl start. useATime is a shorthand for WithTimeField(TimeATime).
+// Directories are always descended into.
+func WithOlderThan(age time.Duration, useATime bool) Option {
+	return func(pc *PosixCrawler) {
+		pc.olderThan = age
+		if useATime {
+			pc.timeField = TimeATime
+		}
+	}
+}
+
+// WithTimeField picks the timestamp used by WithModifiedAfter,
+// WithOlderThan and WithAgeBuckets. The default is TimeMTime.
+func WithTimeField(field TimeField) Option {
+	return func(pc *PosixCrawler) {
+		pc.timeField = field
+	}
+}
+
+// WithDirSummary emits a record for every directory once its subtree is
+// done, with file counts and bytes for the directory itself and for the
+// whole subtree. Only files that pass the filters are counted.
+func WithDirSummary() Option {
+	return func(pc *PosixCrawler) {
+		pc.dirSummary = true
+	}
+}
+
+// WithPathTransform rewrites every emitted path with fn right before it is
+// written out. Transforms run in the order they were added, and only ever
+// from the single output goroutine, so fn needs no locking of its own.
+func WithPathTransform(fn func(string) string) Option {
+	return func(pc *PosixCrawler) {
+		pc.transforms = append(pc.transforms, fn)
+	}
+}
+
+// WithStripPrefix removes prefix from every emitted path under it, so a
+// tree mounted at /mnt/snapshot is reported as if it were at /.
+func WithStripPrefix(prefix string) Option {
+	return WithPathTransform(stripPrefix(prefix))
+}
+
+// WithDangerousOnly only emits files with high risk permissions: setuid or
+// setgid files writable by group or others, and world writable files below
+// any of the sensitive path prefixes.
+func WithDangerousOnly(sensitive ...string) Option {
+	return func(pc *PosixCrawler) {
+		pc.dangerousOnly = true
+		pc.sensitive = sensitive
+	}
+}
+
+// WithSamplePerDir only emits the first file passing the filters in each
+// directory, while still descending into every subdirectory.
+func WithSamplePerDir() Option {
+	return func(pc *PosixCrawler) {
+		pc.samplePerDir = true
+	}
+}
+
+// WithMaxPerOwner emits at most n files owned by any one uid. Which of an
+// owner's files make the cut depends on the crawl order.
+func WithMaxPerOwner(n int) Option {
+	return func(pc *PosixCrawler) {
+		pc.maxPerOwner = int64(n)
+	}
+}
+
+// WithRunID tags every record with id instead of a ULID generated when the
+// crawl starts.
+func WithRunID(id string) Option {
+	return func(pc *PosixCrawler) {
+		pc.runID = id
+	}
+}
+
+// WithPathMode chooses whether records of files reached through followed
+// symlinks carry the resolved physical path, the logical path containing
+// the symlinks, or the physical path plus a separate logical_path field.
+func WithPathMode(mode PathMode) Option {
+	return func(pc *PosixCrawler) {
+		pc.pathMode = mode
+	}
+}
+
+// WithMaxErrors aborts the crawl once n errors have been reported.
+func WithMaxErrors(n int) Option {
+	return func(pc *PosixCrawler) {
+		pc.maxErrors = int64(n)
+	}
+}
+
+// WithoutCTime leaves CTime out of every record.
+func WithoutCTime() Option {
+	return func(pc *PosixCrawler) {
+		pc.noCTime = true
+	}
+}
+
+// WithArchives descends into .tar, .tar.gz, .tgz and .zip files and emits a
+// record for each member, named archive path + "!/" + member path.
+func WithArchives() Option {
+	return func(pc *PosixCrawler) {
+		pc.intoArchives = true
+	}
+}
+
+// WithReadableCheck opens every emitted regular file read-only, closing it
+// straight away, and records whether that succeeded.
+func WithReadableCheck() Option {
+	return func(pc *PosixCrawler) {
+		pc.checkReadable = true
+	}
+}
+
+// WithTextClassification reads the start of every emitted regular file
+// and records whether it looks like text. The reads are done by a pool of
+// as many goroutines as the crawl's concurrency.
+func WithTextClassification() Option {
+	return func(pc *PosixCrawler) {
+		pc.classifyText = true
+	}
+}
+
+// WithEnvelope wraps every JSON record as {"type": ..., "data": ...} and
+// ends the stream with the crawl's errors and a summary record.
+func WithEnvelope() Option {
+	return func(pc *PosixCrawler) {
+		pc.envelope = true
+	}
+}
+
+// WithOneFilesystem never descends into a directory on another device than
+// the root, so mount points inside the tree are skipped.
+func WithOneFilesystem() Option {
+	return func(pc *PosixCrawler) {
+		pc.oneFS = true
+	}
+}
+
+// WithMaxDepth does not descend below depth n, the root being depth 0.
+func WithMaxDepth(n int) Option {
+	return func(pc *PosixCrawler) {
+		pc.maxDepth = n
+	}
+}
+
+// WithMaxDirs stops descending into new directories once n have been
+// queued in total.
+func WithMaxDirs(n int) Option {
+	return func(pc *PosixCrawler) {
+		pc.maxDirs = int64(n)
+	}
+}
+
+// WithSkipMarker does not crawl directories whose listing holds an entry
+// named marker, e.g. CACHEDIR.TAG, the root included. Directories are then
+// read in full before any entry is processed, despite WithReaddirBatch.
+func WithSkipMarker(marker string) Option {
+	return func(pc *PosixCrawler) {
+		pc.skipMarker = marker
+	}
+}
+
+const (
+	safeMaxDepth = 64
+	safeMaxDirs  = 1000000
+)
+
+// WithSafeMode is meant for untrusted trees: symlinks are neither followed
+// nor resolved at the root, the crawl stays on the root's filesystem, and
+// depth and directory count are capped unless already limited.
+func WithSafeMode() Option {
+	return func(pc *PosixCrawler) {
+		pc.followSymlink = false
+		pc.followRoot = false
+		pc.intoArchives = false
+		pc.oneFS = true
+		if pc.maxDepth == 0 {
+			pc.maxDepth = safeMaxDepth
+		}
+		if pc.maxDirs == 0 {
+			pc.maxDirs = safeMaxDirs
+		}
+	}
+}
+
+// WithManifestHash folds the relative path, type, size, mtime and, with
+// WithContentHash, content hash of every emitted record into a digest
+// available from ManifestHash.
+func WithManifestHash() Option {
+	return func(pc *PosixCrawler) {
+		pc.manifestHash = true
+	}
+}
+
+// WithFields only emits the named JSON fields, in declaration order, and
+// skips collecting what nothing needs: files are not stat'ed at all when no
+// stat field is requested and no filter depends on one. Unknown names
+// panic.
+func WithFields(names ...string) Option {
+	return func(pc *PosixCrawler) {
+		pc.projection, pc.fields = projectFields(names)
+	}
+}
+
+// WithContentHash adds the SHA-256 of every emitted file's content.
+func WithContentHash() Option {
+	return func(pc *PosixCrawler) {
+		pc.hashFiles = true
+	}
+}
+
+// WithHashList hashes every file and marks those whose SHA-256 is in
+// hashes, which must be lower case hex. With onlyMatches set, files not in
+// the list are skipped instead.
+func WithHashList(hashes map[string]bool, onlyMatches bool) Option {
+	return func(pc *PosixCrawler) {
+		pc.hashFiles = true
+		pc.hashList = hashes
+		pc.hashListOnly = onlyMatches
+	}
+}
+
+// WithWorkWindow pauses discovery every day outside of the window from
+// start to end, both local wall clock times given as hours and minutes
+// since midnight, as PauseDiscovery does. An end before the start makes
+// the window span midnight. The scheduler overrides PauseDiscovery and
+// ResumeDiscovery calls made while it runs.
+func WithWorkWindow(start, end time.Duration) Option {
+	return func(pc *PosixCrawler) {
+		pc.workWindow = true
+		pc.windowStart = start
+		pc.windowEnd = end
+	}
+}
+
+// WithHumanSizes adds a rounded size such as "1.4 GB" next to the raw
+// byte count, in powers of 1024 (KiB, MiB, ...) when binary is set and of
+// 1000 otherwise.
+func WithHumanSizes(binary bool) Option {
+	return func(pc *PosixCrawler) {
+		pc.humanSizes = true
+		pc.binarySizes = binary
+	}
+}
+
+// WithBaseline marks records whose path is in baseline with a different
+// inode, i.e. files that were replaced rather than modified in place.
+// Paths are compared after the path transforms. With changedOnly set, all
+// other records are dropped.
+func WithBaseline(baseline map[string]uint64, changedOnly bool) Option {
+	return func(pc *PosixCrawler) {
+		pc.baseline = baseline
+		pc.changedOnly = changedOnly
+	}
+}
+
+// WithReaddirBatch reads directories n entries at a time instead of all at
+// once. Larger batches mean fewer getdents calls, smaller ones less memory
+// per directory.
+func WithReaddirBatch(n int) Option {
+	return func(pc *PosixCrawler) {
+		pc.readdirBatch = n
+	}
+}
+
+// WithCheckpoint logs finished directories to checkpointFile so that a
+// crawl restarted with the same file skips what was already written out.
+// Records of a directory are sent together once its listing is done, and
+// the directory is logged once every sink has written them. With
+// WithTopSize, WithSortBySize or WithExternalLinks, which hold records
+// back, directories are only logged when the crawl is done, so a crawl
+// killed before then outputs them again on restart. Directory summaries
+// only cover what the current run crawled. The names-only and openat
+// crawls do not checkpoint.
+func WithCheckpoint(checkpointFile string) Option {
+	return func(pc *PosixCrawler) {
+		pc.checkpointFile = checkpointFile
+	}
+}
+
+// WithExternalLinks sets ExternalLinks on records whose inode has links
+// that were not crawled, e.g. hardlinks outside the root. Unless the output
+// is sorted anyway, records with more than one link are held back until
+// the crawl is done.
+func WithExternalLinks() Option {
+	return func(pc *PosixCrawler) {
+		pc.linkScope = true
+	}
+}
+
+// WithRequireResults makes a crawl that emitted no records at all fail
+// with ErrNoResults.
+func WithRequireResults() Option {
+	return func(pc *PosixCrawler) {
+		pc.requireResult = true
+	}
+}
+
+// WithPhaseTiming accumulates the time all workers spend listing
+// directories, stat'ing entries and writing to the sinks, for PrintStats.
+func WithPhaseTiming() Option {
+	return func(pc *PosixCrawler) {
+		pc.phaseTiming = true
+	}
+}
+
+// WithFullMatch requires the pattern to match the whole path instead of
+// any part of it.
+func WithFullMatch() Option {
+	return func(pc *PosixCrawler) {
+		pc.fullMatch = true
+	}
+}
+
+// WithSortBySize emits all records largest first once the crawl is done,
+// sorting them in memory.
+func WithSortBySize() Option {
+	return func(pc *PosixCrawler) {
+		pc.sortBySize = true
+	}
+}
+
+// WithExternalSort sorts by size like WithSortBySize, but spills sorted
+// runs of about budget bytes to temp files and merges them, so memory stays
+// bounded however many records there are.
+func WithExternalSort(budget int64) Option {
+	return func(pc *PosixCrawler) {
+		pc.sortBySize = true
+		pc.sortBudget = budget
+	}
+}
+
+// WithDirDoneFunc calls fn as soon as a directory's own entries have been
+// processed, without waiting for its subdirectories.
+func WithDirDoneFunc(fn DirDoneFunc) Option {
+	return func(pc *PosixCrawler) {
+		pc.dirDone = fn
+	}
+}
+
+// WithSubtreeDoneFunc calls fn once a directory and everything below it
+// have been processed, with the recursive file count.
+func WithSubtreeDoneFunc(fn DirDoneFunc) Option {
+	return func(pc *PosixCrawler) {
+		pc.subtreeDone = fn
+	}
+}
+
+// WithSink adds a sink every record is fanned out to. Without any sinks
+// records are written to stdout as JSON lines.
+func WithSink(sink Sink) Option {
+	return func(pc *PosixCrawler) {
+		pc.sinks = append(pc.sinks, sink)
+	}
+}
+
+// WithOutput adds a sink writing JSON lines to w.
+func WithOutput(w io.Writer) Option {
+	return func(pc *PosixCrawler) {
+		pc.sinks = append(pc.sinks, &jsonSink{pc: pc, w: w})
+	}
+}
+
+// WithSinkBuffer sets how many records each sink may fall behind by before
+// it blocks the output stage.
+func WithSinkBuffer(n int) Option {
+	return func(pc *PosixCrawler) {
+		pc.sinkBuffer = n
+	}
+}
+
+func NewPosixCrawler(conc int, pattern string, followSymlink bool, opts ...Option) *PosixCrawler {
+	crawler := &PosixCrawler{
+		SubDirs:       make(chan string, 4096),
+		Outputs:       make(chan *PosixInfo, 4096),
+		Error:         make(chan error, 100),
+		wg:            sync.WaitGroup{},
+		concLimit:     make(chan bool, conc),
+		followSymlink: followSymlink,
+		sinkBuffer:    4096,
+		quit:          make(chan bool),
+	}
+
+	for _, opt := range opts {
+		opt(crawler)
+	}
+
+	if len(strings.TrimSpace(pattern)) > 0 {
+		if crawler.fullMatch {
+			pattern = "^(?:" + pattern + ")$"
+		}
+		crawler.pattern = regexp.MustCompile(pattern)
+	}
+	crawler.statFiles = crawler.needsStat()
+
+	return crawler
+}
+
+func (pc *PosixCrawler) Crawl(currPath string) error {
+	return pc.crawl(context.Background(), currPath)
+}
+
+func (pc *PosixCrawler) crawl(ctx context.Context, currPath string) error {
+	logicalRoot := currPath
+	if pc.followRoot {
+		rootPath, err := filepath.EvalSymlinks(currPath)
+		if err != nil {
+			return CrawlErrors{newCrawlError("readlink", currPath, err)}
+		}
+		currPath = rootPath
+	}
+
+	if pc.oneFS {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(currPath, &stat); err != nil {
+			return CrawlErrors{newCrawlError("stat", currPath, err)}
+		}
+		pc.rootDev = uint64(stat.Dev)
+	}
+
+	return pc.run(ctx, currPath, func() {
+		pc.crawlDir(&dirTask{path: currPath, logical: logicalRoot})
+	})
+}
+
+// run starts the output stage, crawls the root with crawlRoot holding the
+// root's worker slot, and collects the errors once everything has drained.
+// Cancelling ctx cancels the crawl.
+func (pc *PosixCrawler) run(ctx context.Context, currPath string, crawlRoot func()) error {
+	if pc.ran {
+		pc.reset()
+	}
+	pc.ran = true
+	if ctx.Done() != nil {
+		stop := make(chan bool)
+		stopped := make(chan bool)
+		go func() {
+			defer close(stopped)
+			select {
+			case <-ctx.Done():
+				pc.cancel(ctx.Err())
+			case <-stop:
+			}
+		}()
+		defer func() {
+			close(stop)
+			<-stopped
+		}()
+	}
+	pc.startTime = time.Now()
+	pc.rootPath = currPath
+	if len(pc.checkpointFile) > 0 {
+		checkpoint, err := openCheckpoint(pc.checkpointFile)
+		if err != nil {
+			return CrawlErrors{newCrawlError("checkpoint", pc.checkpointFile, err)}
+		}
+		defer checkpoint.Close()
+		pc.checkpoint = checkpoint
+	}
+	if len(pc.runID) == 0 {
+		runID, err := newULID(pc.startTime)
+		if err != nil {
+			return CrawlErrors{newCrawlError("crawl", currPath, err)}
+		}
+		pc.runID = runID
+		pc.generatedID = true
+	}
+
+	outputDone := make(chan bool)
+	go func() {
+		pc.outputResult()
+		close(outputDone)
+	}()
+
+	if pc.classifyText && pc.wants("is_text") {
+		pc.startTextReaders(cap(pc.concLimit))
+	}
+	if pc.workWindow {
+		defer pc.startWindow()()
+	}
+
+	pc.wg.Add(1)
+	pc.acquire(0)
+	crawlRoot()
+	pc.wg.Wait()
+	if pc.textQueue != nil {
+		close(pc.textQueue)
+		pc.textQueue = nil
+	}
+
+	close(pc.Outputs)
+	<-outputDone
+
+	close(pc.Error)
+	var errs CrawlErrors
+	for err := range pc.Error {
+		crawlErr, ok := err.(*CrawlError)
+		if !ok {
+			crawlErr = newCrawlError("crawl", "", err)
+		}
+		errs = append(errs, crawlErr)
+	}
+
+	if pc.cancelled() {
+		err := pc.cancelErr
+		if err == ErrTooManyErrors {
+			err = fmt.Errorf("%w: aborted after %d errors", ErrTooManyErrors, atomic.LoadInt64(&pc.errCount))
+		}
+		errs = append(errs, newCrawlError("crawl", currPath, err))
+	}
+
+	if pc.requireResult && atomic.LoadInt64(&pc.stats.emitted) == 0 {
+		errs = append(errs, newCrawlError("crawl", currPath, ErrNoResults))
+	}
+
+	if pc.envelope {
+		pc.writeTrailer(errs)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// reset gives a crawler that already crawled fresh channels and counters
+// for the next crawl.
+func (pc *PosixCrawler) reset() {
+	pc.Outputs = make(chan *PosixInfo, cap(pc.Outputs))
+	pc.Error = make(chan error, cap(pc.Error))
+	pc.quit = make(chan bool)
+	pc.quitOnce = sync.Once{}
+	pc.cancelErr = nil
+	pc.errCount, pc.dirCount = 0, 0
+	pc.stats = crawlStats{}
+	pc.jsonSinks = nil
+	pc.ownerCounts = sync.Map{}
+	pc.manifest = [sha256.Size]byte{}
+	if pc.generatedID {
+		pc.runID, pc.generatedID = "", false
+	}
+}
+
+// RunID identifies the crawl, and is set on every record it emits.
+func (pc *PosixCrawler) RunID() string {
+	return pc.runID
+}
+
+func (pc *PosixCrawler) skip(reason skipReason) {
+	atomic.AddInt64(&pc.stats.skipped[reason], 1)
+}
+
+// phaseStart returns the start of a timed phase, or the zero time when
+// phase timing is off.
+func (pc *PosixCrawler) phaseStart() time.Time {
+	if !pc.phaseTiming {
+		return time.Time{}
+	}
+	return time.Now()
+}
+
+func (pc *PosixCrawler) phaseDone(phase *int64, start time.Time) {
+	if pc.phaseTiming {
+		atomic.AddInt64(phase, int64(time.Since(start)))
+	}
+}
+
+// PrintStats writes how many entries were seen and emitted, and how many
+// each filter rejected, so an unexpectedly small result can be explained.
+func (pc *PosixCrawler) PrintStats(w io.Writer) {
+	fmt.Fprintf(w, "entries: %d\n", atomic.LoadInt64(&pc.stats.entries))
+	fmt.Fprintf(w, "emitted: %d\n", atomic.LoadInt64(&pc.stats.emitted))
+	for reason, name := range skipReasonNames {
+		if n := atomic.LoadInt64(&pc.stats.skipped[reason]); n > 0 {
+			fmt.Fprintf(w, "skipped by %s: %d\n", name, n)
+		}
+	}
+	if len(pc.stats.longestPath) > 0 {
+		fmt.Fprintf(w, "longest path: %d bytes: %s\n", len(pc.stats.longestPath), pc.stats.longestPath)
+	}
+	if pc.phaseTiming {
+		fmt.Fprintf(w, "readdir time: %s\n", time.Duration(atomic.LoadInt64(&pc.stats.readDirTime)))
+		fmt.Fprintf(w, "stat time: %s\n", time.Duration(atomic.LoadInt64(&pc.stats.statTime)))
+		fmt.Fprintf(w, "output time: %s\n", time.Duration(atomic.LoadInt64(&pc.stats.outputTime)))
+	}
+}
+
+func (pc *PosixCrawler) reportError(err *CrawlError) {
+	select {
+	case pc.Error <- err:
+	default:
+	}
+
+	errCount := atomic.AddInt64(&pc.errCount, 1)
+	if pc.maxErrors > 0 && errCount >= pc.maxErrors {
+		pc.cancel(ErrTooManyErrors)
+	}
+}
+
+// cancel stops the crawl: workers return before reading further
+// directories and entries, and the output stage flushes what it has. Only
+// the first cause is kept.
+func (pc *PosixCrawler) cancel(cause error) {
+	pc.quitOnce.Do(func() {
+		pc.cancelErr = cause
+		close(pc.quit)
+	})
+}
+
+func (pc *PosixCrawler) cancelled() bool {
+	select {
+	case <-pc.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (pc *PosixCrawler) depthLimit(depth int) chan bool {
+	for _, limit := range pc.depthLimits {
+		if depth >= limit.minDepth && (limit.maxDepth < 0 || depth <= limit.maxDepth) {
+			return limit.concLimit
+		}
+	}
+	return nil
+}
+
+// acquire takes the depth slot before the global one, so a directory
+// waiting on a busy level never holds a worker other levels could use.
+func (pc *PosixCrawler) acquire(depth int) {
+	if limit := pc.depthLimit(depth); limit != nil {
+		limit <- false
+	}
+	pc.concLimit <- false
+}
+
+func (pc *PosixCrawler) release(depth int) {
+	<-pc.concLimit
+	if limit := pc.depthLimit(depth); limit != nil {
+		<-limit
+	}
+}
+
+// marked reports whether a directory listing holds the skip marker, and
+// counts the skip if it does.
+func (pc *PosixCrawler) marked(entries []os.DirEntry) bool {
+	for _, entry := range entries {
+		if entry.Name() == pc.skipMarker {
+			pc.skip(skipMarker)
+			return true
+		}
+	}
+	return false
+}
+
+// descend applies the one-filesystem, depth and directory count limits to
+// a subdirectory at depth. stat is only needed with WithOneFilesystem.
+func (pc *PosixCrawler) descend(stat *syscall.Stat_t, depth int) bool {
+	if pc.oneFS && uint64(stat.Dev) != pc.rootDev {
+		pc.skip(skipOtherFS)
+		return false
+	}
+	if pc.maxDepth > 0 && depth > pc.maxDepth {
+		pc.skip(skipMaxDepth)
+		return false
+	}
+	if pc.maxDirs > 0 && atomic.AddInt64(&pc.dirCount, 1) > pc.maxDirs {
+		pc.skip(skipMaxDirs)
+		return false
+	}
+	return true
+}
+
+func (pc *PosixCrawler) spawnDir(task *dirTask) {
+	if task.parent != nil {
+		atomic.AddInt32(&task.parent.pending, 1)
+	}
+
+	pc.wg.Add(1)
+	go func() {
+		pc.acquire(task.depth)
+		pc.crawlDir(task)
+	}()
+}
+
+func (pc *PosixCrawler) crawlDir(task *dirTask) {
+	currPath, depth := task.path, task.depth
+	defer pc.wg.Done()
+	defer pc.release(depth)
+	pc.discovery.wait(pc.quit)
+	if pc.cancelled() {
+		return
+	}
+	if pc.namesOnly {
+		pc.crawlNames(task)
+		return
+	}
+	// Subdirectories are checked before they are spawned, the root here.
+	if task.parent == nil && pc.checkpoint != nil && pc.checkpoint.treeDone(currPath) {
+		return
+	}
+
+	var node *dirNode
+	if pc.dirSummary || pc.dirDone != nil || pc.subtreeDone != nil || pc.checkpoint != nil {
+		node = &dirNode{path: currPath, logical: task.logical, parent: task.parent, pending: 1}
+		defer pc.finishDir(node)
+	}
+	if pc.checkpoint != nil {
+		node.batched = true
+		node.skipFiles = pc.checkpoint.dirDone(currPath)
+		defer pc.flushBatch(node)
+	}
+
+	total := 0
+	sampled := false
+	marked := false
+	var folded map[string][]string
+	if pc.caseCollisions {
+		folded = make(map[string][]string)
+	}
+	err := pc.readDirBatches(currPath, func(entries []os.DirEntry) bool {
+		total += len(entries)
+		atomic.AddInt64(&pc.stats.entries, int64(len(entries)))
+		if len(pc.skipMarker) > 0 && pc.marked(entries) {
+			marked = true
+			return false
+		}
+		for _, entry := range entries {
+			pc.discovery.wait(pc.quit)
+			if pc.cancelled() {
+				return false
+			}
+			if folded != nil {
+				key := strings.ToLower(entry.Name())
+				folded[key] = append(folded[key], entry.Name())
+			}
+			pc.crawlEntry(task, node, entry, &sampled)
+		}
+		return true
+	})
+	if err != nil {
+		crawlErr := newCrawlError("readdir", currPath, err)
+		if node != nil {
+			node.err = crawlErr
+		}
+		pc.reportError(crawlErr)
+		return
+	}
+	if marked {
+		return
+	}
+
+	if pc.largeDirs > 0 && total >= pc.largeDirs && (node == nil || !node.skipFiles) {
+		pc.emitDir(task, node, total)
+	}
+	if folded != nil && (node == nil || !node.skipFiles) {
+		pc.emitCollisions(task, node, folded)
+	}
+}
+
+func (pc *PosixCrawler) crawlEntry(task *dirTask, node *dirNode, entry os.DirEntry, sampled *bool) {
+	currPath, depth := task.path, task.depth
+
+	// The entry type comes from d_type, so fi is only filled in by an
+	// lstat once the entry is known to need its full metadata.
+	var fi os.FileInfo
+	var err error
+	fileName := entry.Name()
+	filePath := path.Join(currPath, fileName)
+	logicalPath := path.Join(task.logical, fileName)
+	fileMode := entry.Type()
+
+	if pc.followSymlink && (fileMode&os.ModeSymlink == os.ModeSymlink) {
+		start := pc.phaseStart()
+		newFi, newPath, linkErr := pc.resolveSymlink(currPath, fileName)
+		pc.phaseDone(&pc.stats.statTime, start)
+		if linkErr != nil {
+			pc.reportError(newCrawlError("readlink", path.Join(currPath, fileName), linkErr))
+			return
+		}
+
+		fi = newFi
+		fileName = fi.Name()
+		filePath = path.Join(newPath, fileName)
+		fileMode = fi.Mode()
+	}
+
+	if fileMode.IsDir() {
+		var stat *syscall.Stat_t
+		if pc.oneFS {
+			if fi, err = pc.entryInfo(entry, fi); err != nil {
+				pc.reportError(newCrawlError("lstat", filePath, err))
+				return
+			}
+			stat = fi.Sys().(*syscall.Stat_t)
+		}
+		if !pc.descend(stat, depth+1) {
+			return
+		}
+		if pc.checkpoint != nil && pc.checkpoint.treeDone(filePath) {
+			return
+		}
+		pc.spawnDir(&dirTask{path: filePath, logical: logicalPath, depth: depth + 1, parent: node})
+		return
+	}
+
+	if pc.linkScope && fileMode.IsRegular() {
+		if fi, err = pc.entryInfo(entry, fi); err != nil {
+			pc.reportError(newCrawlError("lstat", filePath, err))
+			return
+		}
+		pc.noteLink(filePath, fi.Sys().(*syscall.Stat_t))
+	}
+
+	if node != nil && node.skipFiles {
+		return
+	}
+
+	if pc.symlinkInfo && fileMode&os.ModeSymlink != 0 {
+		if pc.largeDirs > 0 || pc.caseCollisions {
+			return
+		}
+		if pc.pattern != nil && !pc.pattern.MatchString(filePath) {
+			pc.skip(skipRegexp)
+			return
+		}
+		if fi, err = pc.entryInfo(entry, fi); err != nil {
+			pc.reportError(newCrawlError("lstat", filePath, err))
+			return
+		}
+		pc.emitSymlink(filePath, fi, node)
+		return
+	}
+
+	if !fileMode.IsRegular() {
+		return
+	}
+
+	if pc.largeDirs > 0 || pc.caseCollisions {
+		return
+	}
+
+	if pc.intoArchives && isArchive(fileName) {
+		pc.crawlArchive(filePath, logicalPath, node, sampled)
+	}
+
+	if pc.pattern != nil && !pc.pattern.MatchString(filePath) {
+		pc.skip(skipRegexp)
+		return
+	}
+
+	if !pc.statFiles {
+		pc.processFile(filePath, logicalPath, nil, node, sampled)
+		return
+	}
+	if fi, err = pc.entryInfo(entry, fi); err != nil {
+		pc.reportError(newCrawlError("lstat", filePath, err))
+		return
+	}
+	pc.processFile(filePath, logicalPath, fi.Sys().(*syscall.Stat_t), node, sampled)
+}
+
+// processFile runs a regular file through the metadata filters and emits
+// its record. sampled tracks -sample-per-dir for the file's directory.
+// stat is nil when no filter or field needs it.
+func (pc *PosixCrawler) processFile(filePath string, logicalPath string, stat *syscall.Stat_t, node *dirNode, sampled *bool) {
+	risks, hash, ok := pc.filterFile(filePath, stat, sampled, false)
+	if !ok {
+		return
+	}
+
+	info := &PosixInfo{FilePath: filePath, Type: "file"}
+	if stat != nil {
+		info = pc.newPosixInfo(filePath, "file", stat)
+	}
+	info.Risks = risks
+	info.SHA256 = hash
+	info.HashListMatch = pc.hashList[hash]
+	if pc.checkReadable && pc.wants("readable") {
+		readable := isReadable(filePath)
+		info.Readable = &readable
+	}
+	pc.fileRecord(info, stat, logicalPath, node)
+	if pc.textQueue != nil {
+		// Batched records are sent along with their directory, so
+		// those are classified right here.
+		if node == nil || !node.batched {
+			pc.wg.Add(1)
+			pc.textQueue <- textJob{filePath: filePath, info: info}
+			return
+		}
+		pc.setText(filePath, info)
+	}
+	pc.emit(node, info)
+}
+
+// fileRecord adds what every file record that passed the filters carries,
+// archive members included, and counts the file in its directory summary.
+func (pc *PosixCrawler) fileRecord(info *PosixInfo, stat *syscall.Stat_t, logicalPath string, node *dirNode) {
+	if len(pc.ageBuckets) > 0 {
+		info.AgeBucket = pc.ageBucket(pc.filterTime(stat))
+	}
+	if pc.anomalies {
+		info.Anomalies = pc.timestampAnomalies(info)
+	}
+	pc.setLogicalPath(info, logicalPath)
+	if node != nil {
+		node.summary.Files++
+		node.summary.Bytes += info.Size
+	}
+}
+
+// filterFile runs a file through the metadata filters, counting the skip
+// of one that rejects it, and returns the -find-dangerous risks and the
+// content hash. An archive member has no content to hash, so it only
+// passes -hash-list-only as a mismatch would.
+func (pc *PosixCrawler) filterFile(filePath string, stat *syscall.Stat_t, sampled *bool, member bool) ([]string, string, bool) {
+	if pc.checkMode && stat.Mode&permBits == pc.expectMode {
+		pc.skip(skipExpectMode)
+		return nil, "", false
+	}
+
+	var risks []string
+	if pc.dangerousOnly {
+		if risks = pc.permissionRisks(filePath, stat.Mode); len(risks) == 0 {
+			pc.skip(skipDangerous)
+			return nil, "", false
+		}
+	}
+
+	if !pc.modifiedAfter.IsZero() && !pc.filterTime(stat).After(pc.modifiedAfter) {
+		pc.skip(skipModifiedAfter)
+		return nil, "", false
+	}
+
+	if pc.olderThan > 0 && !pc.filterTime(stat).Before(pc.startTime.Add(-pc.olderThan)) {
+		pc.skip(skipOlderThan)
+		return nil, "", false
+	}
+
+	var hash string
+	if pc.hashFiles {
+		if !member {
+			var err error
+			if hash, err = hashFile(filePath); err != nil {
+				pc.reportError(newCrawlError("hash", filePath, err))
+				return nil, "", false
+			}
+		}
+		if pc.hashListOnly && !pc.hashList[hash] {
+			pc.skip(skipHashList)
+			return nil, "", false
+		}
+	}
+
+	if pc.samplePerDir && *sampled {
+		pc.skip(skipSample)
+		return nil, "", false
+	}
+
+	if pc.maxPerOwner > 0 && !pc.ownerAllowed(stat.Uid) {
+		pc.skip(skipMaxPerOwner)
+		return nil, "", false
+	}
+
+	if pc.samplePerDir {
+		*sampled = true
+	}
+	return risks, hash, true
+}
+
+// ownerAllowed counts a file against uid's cap and reports whether it is
+// still within it.
+func (pc *PosixCrawler) ownerAllowed(uid uint32) bool {
+	count, _ := pc.ownerCounts.LoadOrStore(uid, new(int64))
+	return atomic.AddInt64(count.(*int64), 1) <= pc.maxPerOwner
+}
+
+func (pc *PosixCrawler) setLogicalPath(info *PosixInfo, logicalPath string) {
+	switch pc.pathMode {
+	case PathLogical:
+		info.FilePath = logicalPath
+	case PathBoth:
+		info.LogicalPath = logicalPath
+	}
+}
+
+func (pc *PosixCrawler) permissionRisks(filePath string, mode uint32) []string {
+	var risks []string
+	writable := mode&(syscall.S_IWGRP|syscall.S_IWOTH) != 0
+	if mode&syscall.S_ISUID != 0 && writable {
+		risks = append(risks, "setuid_writable")
+	}
+	if mode&syscall.S_ISGID != 0 && writable {
+		risks = append(risks, "setgid_writable")
+	}
+	if mode&syscall.S_IWOTH != 0 {
+		for _, prefix := range pc.sensitive {
+			if filePath == prefix || strings.HasPrefix(filePath, strings.TrimSuffix(prefix, "/")+"/") {
+				risks = append(risks, "world_writable_sensitive")
+				break
+			}
+		}
+	}
+	return risks
+}
+
+func (pc *PosixCrawler) finishDir(node *dirNode) {
+	atomic.AddInt64(&node.summary.RecursiveFiles, node.summary.Files)
+	atomic.AddInt64(&node.summary.RecursiveBytes, node.summary.Bytes)
+	if pc.dirDone != nil {
+		pc.dirDone(node.path, int(node.summary.Files), node.err)
+	}
+
+	if node.err != nil {
+		atomic.StoreInt32(&node.failed, 1)
+	}
+	for node != nil && atomic.AddInt32(&node.pending, -1) == 0 {
+		failed := atomic.LoadInt32(&node.failed) != 0
+		if failed && node.parent != nil {
+			atomic.StoreInt32(&node.parent.failed, 1)
+		}
+		if pc.subtreeDone != nil {
+			pc.subtreeDone(node.path, int(node.summary.RecursiveFiles), node.err)
+		}
+		if pc.dirSummary {
+			if info := pc.dirInfo(node.path); info != nil {
+				summary := node.summary
+				info.Summary = &summary
+				pc.setLogicalPath(info, node.logical)
+				pc.Outputs <- info
+			}
+		}
+		if pc.checkpoint != nil && !pc.cancelled() && !failed {
+			pc.Outputs <- &PosixInfo{commit: &dirCommit{kind: "tree", path: node.path}}
+		}
+
+		if node.parent != nil {
+			atomic.AddInt64(&node.parent.summary.RecursiveFiles, node.summary.RecursiveFiles)
+			atomic.AddInt64(&node.parent.summary.RecursiveBytes, node.summary.RecursiveBytes)
+		}
+		node = node.parent
+	}
+}
+
+// timestampAnomalies applies the usual timestomping heuristics: CTime can
+// not be set from user space, so an MTime ahead of it, far behind it, or
+// rounded to the second while CTime is not, points at a rewritten MTime.
+// The CTime checks are skipped when CTime is not collected.
+func (pc *PosixCrawler) timestampAnomalies(info *PosixInfo) []string {
+	var anomalies []string
+	if info.MTime.After(pc.startTime) {
+		anomalies = append(anomalies, "mtime_in_future")
+	}
+	if info.ATime.After(pc.startTime) {
+		anomalies = append(anomalies, "atime_in_future")
+	}
+
+	if info.CTime == nil {
+		return anomalies
+	}
+	if info.CTime.After(pc.startTime) {
+		anomalies = append(anomalies, "ctime_in_future")
+	}
+	if info.MTime.After(*info.CTime) {
+		anomalies = append(anomalies, "mtime_after_ctime")
+	}
+	if pc.anomalyGap > 0 && info.CTime.Sub(info.MTime) > pc.anomalyGap {
+		anomalies = append(anomalies, "mtime_before_ctime")
+	}
+	if info.MTime.Nanosecond() == 0 && info.CTime.Nanosecond() != 0 {
+		anomalies = append(anomalies, "mtime_whole_second")
+	}
+	return anomalies
+}
+
+func (pc *PosixCrawler) filterTime(stat *syscall.Stat_t) time.Time {
+	switch pc.timeField {
+	case TimeATime:
+		return timespecToTime(stat.Atim)
+	case TimeCTime:
+		return timespecToTime(stat.Ctim)
+	}
+	return timespecToTime(stat.Mtim)
+}
+
+func (pc *PosixCrawler) ageBucket(t time.Time) string {
+	age := pc.startTime.Sub(t)
+	for _, bucket := range pc.ageBuckets {
+		if bucket.upper < 0 || age < bucket.upper {
+			return bucket.label
+		}
+	}
+	return ""
+}
+
+func (pc *PosixCrawler) crawlNames(task *dirTask) {
+	currPath := task.path
+	var folded map[string][]string
+	if pc.caseCollisions {
+		folded = make(map[string][]string)
+	}
+	marked := false
+	err := pc.readDirBatches(currPath, func(entries []os.DirEntry) bool {
+		atomic.AddInt64(&pc.stats.entries, int64(len(entries)))
+		if len(pc.skipMarker) > 0 && pc.marked(entries) {
+			marked = true
+			return false
+		}
+		for _, entry := range entries {
+			pc.discovery.wait(pc.quit)
+			if pc.cancelled() {
+				return false
+			}
+			if folded != nil {
+				key := strings.ToLower(entry.Name())
+				folded[key] = append(folded[key], entry.Name())
+			}
+
+			filePath := path.Join(currPath, entry.Name())
+			if entry.IsDir() {
+				// Directories are only stat'ed for WithOneFilesystem.
+				var stat *syscall.Stat_t
+				if pc.oneFS {
+					fi, err := pc.entryInfo(entry, nil)
+					if err != nil {
+						pc.reportError(newCrawlError("lstat", filePath, err))
+						continue
+					}
+					stat = fi.Sys().(*syscall.Stat_t)
+				}
+				if pc.descend(stat, task.depth+1) {
+					pc.spawnDir(&dirTask{path: filePath, logical: filePath, depth: task.depth + 1})
+				}
+			}
+
+			if folded != nil {
+				continue
+			}
+			if pc.pattern != nil && !pc.pattern.MatchString(filePath) {
+				pc.skip(skipRegexp)
+				continue
+			}
+
+			pc.Outputs <- &PosixInfo{FilePath: filePath, Type: fileTypeName(entry.Type())}
+		}
+		return true
+	})
+	if err != nil {
+		pc.reportError(newCrawlError("readdir", currPath, err))
+		return
+	}
+	if folded != nil && !marked {
+		pc.emitCollisions(task, nil, folded)
+	}
+}
+
+func (pc *PosixCrawler) emitSymlink(linkPath string, fi os.FileInfo, node *dirNode) {
+	info := pc.newPosixInfo(linkPath, "symlink", fi.Sys().(*syscall.Stat_t))
+	if pc.wants("raw_link_target") {
+		rawTarget, err := os.Readlink(linkPath)
+		if err != nil {
+			pc.reportError(newCrawlError("readlink", linkPath, err))
+			return
+		}
+		info.RawLinkTarget = rawTarget
+	}
+
+	if !pc.wants("target") {
+		pc.emit(node, info)
+		return
+	}
+	targetPath, err := filepath.EvalSymlinks(linkPath)
+	if err == nil {
+		targetFi, err := os.Lstat(targetPath)
+		if err == nil {
+			info.Target = pc.newPosixInfo(targetPath, fileTypeName(targetFi.Mode()), targetFi.Sys().(*syscall.Stat_t))
+		}
+	}
+	pc.emit(node, info)
+}
+
+func (pc *PosixCrawler) emitDir(task *dirTask, node *dirNode, entries int) {
+	if info := pc.dirInfo(task.path); info != nil {
+		info.Entries = entries
+		pc.setLogicalPath(info, task.logical)
+		pc.emit(node, info)
+	}
+}
+
+// emitCollisions emits a record for every lowercased name more than one
+// entry of the directory shares, listing the entries' paths in the same
+// path mode as the directory's own.
+func (pc *PosixCrawler) emitCollisions(task *dirTask, node *dirNode, folded map[string][]string) {
+	var keys []string
+	for key, names := range folded {
+		if len(names) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	dirPath := task.path
+	if pc.pathMode == PathLogical {
+		dirPath = task.logical
+	}
+	for _, key := range keys {
+		names := folded[key]
+		sort.Strings(names)
+		paths := make([]string, len(names))
+		for i, name := range names {
+			paths[i] = path.Join(dirPath, name)
+		}
+		info := &PosixInfo{FilePath: task.path, Type: "case_collision", CaseCollisions: paths}
+		pc.setLogicalPath(info, task.logical)
+		pc.emit(node, info)
+	}
+}
+
+func (pc *PosixCrawler) dirInfo(dirPath string) *PosixInfo {
+	fi, err := os.Stat(dirPath)
+	if err != nil {
+		pc.reportError(newCrawlError("stat", dirPath, err))
+		return nil
+	}
+
+	return pc.newPosixInfo(dirPath, "dir", fi.Sys().(*syscall.Stat_t))
+}
+
+func isReadable(filePath string) bool {
+	fd, err := syscall.Open(filePath, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return false
+	}
+	syscall.Close(fd)
+	return true
+}
+
+// entryInfo returns fi when the entry was already stat'ed, e.g. through a
+// followed symlink, and lstats it otherwise.
+func (pc *PosixCrawler) entryInfo(entry os.DirEntry, fi os.FileInfo) (os.FileInfo, error) {
+	if fi != nil {
+		return fi, nil
+	}
+
+	start := pc.phaseStart()
+	fi, err := entry.Info()
+	pc.phaseDone(&pc.stats.statTime, start)
+	return fi, err
+}
+
+// readDirBatches hands fn the directory's entries in batches of at most
+// WithReaddirBatch entries, or all at once without a batch size or with a
+// skip marker, until the directory is exhausted or fn returns false. The
+// directory stays open in between, so filtering starts before a huge
+// directory is fully read.
+func (pc *PosixCrawler) readDirBatches(dirPath string, fn func([]os.DirEntry) bool) error {
+	f, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	batch := pc.readdirBatch
+	if len(pc.skipMarker) > 0 {
+		batch = 0
+	}
+	for {
+		start := pc.phaseStart()
+		entries, err := f.ReadDir(batch)
+		pc.phaseDone(&pc.stats.readDirTime, start)
+		if len(entries) > 0 && !fn(entries) {
+			return nil
+		}
+		if err == io.EOF || err == nil && batch <= 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (pc *PosixCrawler) resolveSymlink(currPath string, linkName string) (os.FileInfo, string, error) {
+	filePath := currPath
+	linkName = path.Join(filePath, linkName)
+	fileName, err := os.Readlink(linkName)
+	if err != nil {
+		return nil, "", err
+	}
+	if !path.IsAbs(fileName) {
+		fileName = path.Join(filePath, fileName)
+	}
+	fileName = filepath.Clean(fileName)
+	filePath = filepath.Dir(fileName)
+
+	isSymlink := true
+	filesSeen := make(map[string]bool)
+
+	for {
+		fi, err := os.Lstat(fileName)
+		if err != nil {
+			return nil, "", err
+		}
+
+		if _, found := filesSeen[fileName]; found {
+			return nil, "", newCrawlError("readlink", linkName, errCircularSymlink)
+		}
+		filesSeen[fileName] = false
+
+		isSymlink = fi.Mode()&os.ModeSymlink == os.ModeSymlink
+		if isSymlink {
+			fileName, err = os.Readlink(fileName)
+			if err != nil {
+				return nil, "", err
+			}
+			if !path.IsAbs(fileName) {
+				fileName = path.Join(filePath, fileName)
+			}
+			fileName = filepath.Clean(fileName)
+			filePath = filepath.Dir(fileName)
+			continue
+		} else {
+			return fi, filePath, nil
+		}
+	}
+
+}
+
+func (pc *PosixCrawler) outputResult() {
+	sinks := pc.sinks
+	if len(sinks) == 0 {
+		sinks = []Sink{&jsonSink{pc: pc, w: os.Stdout}}
+	}
+
+	var sinkWg sync.WaitGroup
+	pc.sinkQueues = make([]chan *PosixInfo, len(sinks))
+	for i, sink := range sinks {
+		if js, ok := sink.(*jsonSink); ok {
+			pc.jsonSinks = append(pc.jsonSinks, js)
+		}
+		queue := make(chan *PosixInfo, pc.sinkBuffer)
+		pc.sinkQueues[i] = queue
+
+		sinkWg.Add(1)
+		go func(sink Sink) {
+			defer sinkWg.Done()
+			pc.runSink(sink, queue)
+		}(sink)
+	}
+
+	if pc.topSize > 0 {
+		pc.outputTopSize()
+	} else if pc.sortBySize {
+		pc.outputSorted()
+	} else {
+		for info := range pc.Outputs {
+			if info.commit != nil {
+				pc.commitDir(info)
+				continue
+			}
+			pc.writeInfo(info)
+		}
+	}
+	if pc.linkScope {
+		pc.flushLinks()
+	}
+	for _, info := range pc.heldCommits {
+		pc.sendCommit(info)
+	}
+	pc.heldCommits = nil
+
+	for _, queue := range pc.sinkQueues {
+		close(queue)
+	}
+	sinkWg.Wait()
+}
+
+// runSink keeps draining queue after a write error so a broken sink can
+// never block the others.
+func (pc *PosixCrawler) runSink(sink Sink, queue chan *PosixInfo) {
+	failed := false
+	for info := range queue {
+		if info.commit != nil {
+			pc.sinkCommitted(sink, info.commit, failed)
+			continue
+		}
+		if failed {
+			continue
+		}
+		start := pc.phaseStart()
+		err := sink.Write(info)
+		pc.phaseDone(&pc.stats.outputTime, start)
+		if err != nil {
+			pc.reportError(newCrawlError("write", "sink", err))
+			failed = true
+		}
+	}
+}
+
+// outputTopSize keeps the largest topSize records in a min-heap so memory
+// stays bounded no matter how many files are crawled.
+func (pc *PosixCrawler) outputTopSize() {
+	largest := &sizeHeap{}
+	for info := range pc.Outputs {
+		if info.commit != nil {
+			pc.commitDir(info)
+			continue
+		}
+		if largest.Len() < pc.topSize {
+			heap.Push(largest, info)
+		} else if info.Size > (*largest)[0].Size {
+			(*largest)[0] = info
+			heap.Fix(largest, 0)
+		}
+	}
+
+	sorted := make([]*PosixInfo, largest.Len())
+	for i := len(sorted) - 1; i >= 0; i-- {
+		sorted[i] = heap.Pop(largest).(*PosixInfo)
+	}
+	for _, info := range sorted {
+		pc.writeInfo(info)
+	}
+}
+
+func (pc *PosixCrawler) transformPath(filePath string) string {
+	for _, transform := range pc.transforms {
+		filePath = transform(filePath)
+	}
+	return filePath
+}
+
+func (pc *PosixCrawler) writeInfo(info *PosixInfo) {
+	if pc.linkScope && info.Nlink > 1 && info.Type != "dir" {
+		if pc.topSize == 0 && !pc.sortBySize {
+			pc.heldLinks = append(pc.heldLinks, info)
+			return
+		}
+		pc.setExternalLinks(info)
+	}
+	pc.sendInfo(info)
+}
+
+func (pc *PosixCrawler) sendInfo(info *PosixInfo) {
+	pc.output.wait(pc.quit)
+	filePath := info.FilePath
+	if len(pc.transforms) > 0 {
+		filePath = pc.transformPath(filePath)
+	}
+
+	if pc.baseline != nil {
+		inode, ok := pc.baseline[filePath]
+		info.InodeChanged = ok && info.INode != 0 && inode != info.INode
+		if pc.changedOnly && !info.InodeChanged {
+			pc.skip(skipInodeChanged)
+			return
+		}
+	}
+
+	// The manifest only covers emitted records, by their untransformed
+	// path relative to the root.
+	if pc.manifestHash {
+		pc.foldManifest(info)
+	}
+	info.FilePath = filePath
+	if len(pc.transforms) > 0 {
+		if info.Target != nil {
+			info.Target.FilePath = pc.transformPath(info.Target.FilePath)
+		}
+		for i, collision := range info.CaseCollisions {
+			info.CaseCollisions[i] = pc.transformPath(collision)
+		}
+	}
+
+	info.RunID = pc.runID
+	info.TypeChar = typeChar(info.Type)
+	if info.Target != nil {
+		info.Target.TypeChar = typeChar(info.Target.Type)
+	}
+	if pc.humanSizes {
+		info.SizeHuman = formatSize(info.Size, pc.binarySizes)
+	}
+	atomic.AddInt64(&pc.stats.emitted, 1)
+	if len(info.FilePath) > len(pc.stats.longestPath) {
+		pc.stats.longestPath = info.FilePath
+	}
+	for _, queue := range pc.sinkQueues {
+		queue <- info
+	}
+}
+
+// foldManifest adds the record's hash into the manifest modulo 2^256, so the
+// result does not depend on the order records arrive in. Unlike XOR, a
+// record reached twice does not cancel itself out. Paths are taken relative
+// to the root to let copies of a tree in different places compare equal.
+func (pc *PosixCrawler) foldManifest(info *PosixInfo) {
+	relPath, err := filepath.Rel(pc.rootPath, info.FilePath)
+	if err != nil {
+		relPath = info.FilePath
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%s", relPath, info.Type, info.Size, info.MTime.UnixNano(), info.SHA256)))
+	carry := 0
+	for i := len(pc.manifest) - 1; i >= 0; i-- {
+		carry += int(pc.manifest[i]) + int(sum[i])
+		pc.manifest[i] = byte(carry)
+		carry >>= 8
+	}
+}
+
+// ManifestHash returns the order independent digest of every record the
+// last crawl emitted, or an empty string without WithManifestHash.
+func (pc *PosixCrawler) ManifestHash() string {
+	if !pc.manifestHash {
+		return ""
+	}
+	return fmt.Sprintf("%x", pc.manifest)
+}
+
+func (pc *PosixCrawler) marshal(info *PosixInfo) []byte {
+	var data interface{} = info
+	if pc.projection != nil {
+		data = pc.project(info)
+	} else if info.Type == "case_collision" {
+		data = collisionInfo{FilePath: info.FilePath, Type: info.Type, CaseCollisions: info.CaseCollisions, LogicalPath: info.LogicalPath, RunID: info.RunID}
+	} else if pc.namesOnly {
+		data = nameInfo{FilePath: info.FilePath, Type: info.Type}
+	}
+	if pc.envelope {
+		data = envelope{Type: info.Type, Data: data}
+	}
+	out, _ := json.Marshal(data)
+	return out
+}
+
+// writeTrailer closes an enveloped JSON stream with one error record per
+// crawl error and a final summary record. It runs once the sinks are done.
+func (pc *PosixCrawler) writeTrailer(errs CrawlErrors) {
+	summary := summaryRecord{
+		RunID:   pc.runID,
+		Entries: atomic.LoadInt64(&pc.stats.entries),
+		Emitted: atomic.LoadInt64(&pc.stats.emitted),
+		Errors:  len(errs),
+
+		ManifestHash: pc.ManifestHash(),
+	}
+	for reason, name := range skipReasonNames {
+		if n := atomic.LoadInt64(&pc.stats.skipped[reason]); n > 0 {
+			if summary.Skipped == nil {
+				summary.Skipped = make(map[string]int64)
+			}
+			summary.Skipped[name] = n
+		}
+	}
+
+	for _, sink := range pc.jsonSinks {
+		for _, err := range errs {
+			sink.writeEnvelope("error", errorRecord{Op: err.Op, Path: err.Path, Kind: err.Kind.String(), Error: err.Err.Error()})
+		}
+		sink.writeEnvelope("summary", summary)
+	}
+}
+
+type sizeHeap []*PosixInfo
+
+func (h sizeHeap) Len() int            { return len(h) }
+func (h sizeHeap) Less(i, j int) bool  { return h[i].Size < h[j].Size }
+func (h sizeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *sizeHeap) Push(x interface{}) { *h = append(*h, x.(*PosixInfo)) }
+
+func (h *sizeHeap) Pop() interface{} {
+	old := *h
+	info := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return info
+}
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassShift = 13
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioLowestBE   = 7
+)
+
+// setIOPriority sets the I/O scheduling class of every thread in the
+// process. Threads the runtime starts later inherit it on clone.
+func setIOPriority(class string) error {
+	var prio uintptr
+	switch class {
+	case "idle":
+		prio = ioprioClassIdle << ioprioClassShift
+	case "best-effort":
+		prio = ioprioClassBE<<ioprioClassShift | ioprioLowestBE
+	default:
+		return fmt.Errorf("unknown I/O class %q", class)
+	}
+
+	tasks, err := ioutil.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), prio)
+		if errno != 0 {
+			return os.NewSyscallError("ioprio_set", errno)
+		}
+	}
+	return nil
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newULID returns a ULID: a 48 bit millisecond timestamp followed by 80
+// random bits, so IDs of later runs sort after earlier ones.
+func newULID(t time.Time) (string, error) {
+	var id [16]byte
+	ms := uint64(t.UnixNano() / int64(time.Millisecond))
+	binary.BigEndian.PutUint16(id[0:2], uint16(ms>>32))
+	binary.BigEndian.PutUint32(id[2:6], uint32(ms))
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = crockfordBase32[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:]), nil
+}
+
+// replacePrefix returns a transform replacing the leading path components
+// from with to. Paths outside from are returned unchanged.
+func replacePrefix(from string, to string) func(string) string {
+	from = path.Clean(from)
+	dirPrefix := strings.TrimSuffix(from, "/") + "/"
+	return func(filePath string) string {
+		if filePath != from && !strings.HasPrefix(filePath, dirPrefix) {
+			return filePath
+		}
+		if from == "/" {
+			return to + filePath
+		}
+		return to + filePath[len(from):]
+	}
+}
+
+// stripPrefix drops prefix from paths under it, leaving them absolute.
+func stripPrefix(prefix string) func(string) string {
+	replace := replacePrefix(prefix, "")
+	return func(filePath string) string {
+		if filePath = replace(filePath); len(filePath) == 0 {
+			return "/"
+		}
+		return filePath
+	}
 }
 
-type PosixCrawler struct {
-	SubDirs       chan string
-	Outputs       chan *PosixInfo
-	Error         chan error
-	wg            sync.WaitGroup
-	concLimit     chan bool
-	pattern       *regexp.Regexp
-	followSymlink bool
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
 }
 
-func NewPosixCrawler(conc int, pattern string, followSymlink bool) *PosixCrawler {
-	crawler := &PosixCrawler{
-		SubDirs:       make(chan string, 4096),
-		Outputs:       make(chan *PosixInfo, 4096),
-		Error:         make(chan error, 100),
-		wg:            sync.WaitGroup{},
-		concLimit:     make(chan bool, conc),
-		followSymlink: followSymlink,
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func (l *stringList) Get() interface{} {
+	return append([]string{}, *l...)
+}
+
+// printConfig writes every flag's effective value, defaults included, and
+// the absolute, symlink resolved root as one JSON object. Settings the
+// crawler derives from other flags, such as the limits of -safe or the
+// -modified-after time of -since-marker, are taken from pc.
+func printConfig(w io.Writer, flagSet *flag.FlagSet, pc *PosixCrawler, rootDir string) {
+	config := map[string]interface{}{}
+	flagSet.VisitAll(func(f *flag.Flag) {
+		if getter, ok := f.Value.(flag.Getter); ok {
+			config[f.Name] = getter.Get()
+		} else {
+			config[f.Name] = f.Value.String()
+		}
+	})
+
+	config["follow-symlinks"] = pc.followSymlink
+	config["follow-root-only"] = pc.followRoot
+	config["into-archives"] = pc.intoArchives
+	config["one-fs"] = pc.oneFS
+	config["max-depth"] = pc.maxDepth
+	config["max-dirs"] = pc.maxDirs
+	config["time-field"] = [...]string{"mtime", "atime", "ctime"}[pc.timeField]
+	config["hash"] = pc.hashFiles
+	if !pc.modifiedAfter.IsZero() {
+		config["modified-after"] = pc.modifiedAfter.Format(time.RFC3339Nano)
 	}
 
-	if len(strings.TrimSpace(pattern)) > 0 {
-		crawler.pattern = regexp.MustCompile(pattern)
+	root, err := filepath.Abs(rootDir)
+	if err == nil {
+		if resolved, err := filepath.EvalSymlinks(root); err == nil {
+			root = resolved
+		}
 	}
+	config["root"] = root
 
-	return crawler
+	out, _ := json.Marshal(config)
+	fmt.Fprintf(w, "%s\n", out)
 }
 
-func (pc *PosixCrawler) Crawl(currPath string) error {
-	go pc.outputResult()
+// formatSize formats size with one decimal in the largest unit below it,
+// e.g. 1.5 MB, or 1.4 MiB with binary units.
+func formatSize(size int64, binary bool) string {
+	unit, units := int64(1000), "kMGTPE"
+	if binary {
+		unit = 1024
+	}
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
 
-	pc.wg.Add(1)
-	pc.concLimit <- false
-	pc.crawlDir(currPath)
-	pc.wg.Wait()
+	// The unit is picked after rounding, so 999999 bytes are 1.0 MB and
+	// not 1000.0 kB.
+	value, exp := float64(size)/float64(unit), 0
+	for math.Round(value*10) >= float64(unit)*10 && exp < len(units)-1 {
+		value /= float64(unit)
+		exp++
+	}
+	suffix := string(units[exp]) + "B"
+	if binary {
+		suffix = strings.ToUpper(string(units[exp])) + "iB"
+	}
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
 
-	close(pc.Outputs)
-	pc.outputResult()
+// parseAge is time.ParseDuration with an extra "d" unit for days.
+func parseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
 
-	close(pc.Error)
-	var errors []string
-	for err := range pc.Error {
-		errors = append(errors, err.Error())
+	return time.ParseDuration(s)
+}
+
+func formatAge(d time.Duration) string {
+	switch day := 24 * time.Hour; {
+	case d > 0 && d%day == 0:
+		return fmt.Sprintf("%dd", d/day)
+	case d > 0 && d%time.Hour == 0:
+		return fmt.Sprintf("%dh", d/time.Hour)
+	case d > 0 && d%time.Minute == 0:
+		return fmt.Sprintf("%dm", d/time.Minute)
+	}
+	return d.String()
+}
+
+// parseDepthLimit parses "depth:conc", "min-max:conc" or "min+:conc".
+func parseDepthLimit(spec string) (int, int, int, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ":")
+	if len(parts) != 2 {
+		return 0, 0, 0, fmt.Errorf("expected depth:conc, got %q", spec)
 	}
 
-	if len(errors) > 0 {
-		return fmt.Errorf(strings.Join(errors, "\n"))
+	conc, err := strconv.Atoi(parts[1])
+	if err != nil || conc < 1 {
+		return 0, 0, 0, fmt.Errorf("invalid concurrency in %q", spec)
 	}
 
-	return nil
+	depths := parts[0]
+	var minDepth, maxDepth int
+	switch {
+	case strings.HasSuffix(depths, "+"):
+		minDepth, err = strconv.Atoi(strings.TrimSuffix(depths, "+"))
+		maxDepth = -1
+	case strings.Contains(depths, "-"):
+		bounds := strings.SplitN(depths, "-", 2)
+		minDepth, err = strconv.Atoi(bounds[0])
+		if err == nil {
+			maxDepth, err = strconv.Atoi(bounds[1])
+		}
+	default:
+		minDepth, err = strconv.Atoi(depths)
+		maxDepth = minDepth
+	}
+	if err != nil || minDepth < 0 || (maxDepth >= 0 && maxDepth < minDepth) {
+		return 0, 0, 0, fmt.Errorf("invalid depth range in %q", spec)
+	}
+
+	return minDepth, maxDepth, conc, nil
 }
 
-func (pc *PosixCrawler) crawlDir(currPath string) {
-	defer pc.wg.Done()
-	defer func() { <-pc.concLimit }()
-	files, err := readDir(currPath)
+// fdHeadroom is kept free of the open file limit for stdio, output files
+// and the runtime.
+const fdHeadroom = 64
+
+// fdConcLimit returns the highest concurrency the soft RLIMIT_NOFILE
+// allows, each worker holding one directory open at a time.
+func fdConcLimit() (int, error) {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0, err
+	}
+	if rlimit.Cur <= fdHeadroom {
+		return 1, nil
+	}
+	if rlimit.Cur-fdHeadroom > math.MaxInt32 {
+		return math.MaxInt32, nil
+	}
+	return int(rlimit.Cur - fdHeadroom), nil
+}
+
+// readMarker returns the crawl start time stored in a marker file.
+// A missing marker yields the zero time so the first run crawls everything.
+func readMarker(markerFile string) (time.Time, error) {
+	data, err := ioutil.ReadFile(markerFile)
+	if os.IsNotExist(err) {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+}
+
+func writeMarker(markerFile string, t time.Time) error {
+	tmpFile := markerFile + ".tmp"
+	err := ioutil.WriteFile(tmpFile, []byte(t.UTC().Format(time.RFC3339Nano)+"\n"), 0644)
 	if err != nil {
-		select {
-		case pc.Error <- err:
-		default:
+		return err
+	}
+
+	return os.Rename(tmpFile, markerFile)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		panic("please specify root directory to crawl")
+	}
+
+	rootDir := os.Args[1]
+	var pattern string
+	var modifiedAfter string
+	var sinceMarker string
+	var largeDirs int
+	var caseCollisions bool
+	var followRootOnly bool
+	var ageBuckets string
+	var depthConc string
+	var topSize int
+	var timestampAnomaly bool
+	anomalyGap := "365d"
+	var ionice string
+	var expectMode string
+	var namesOnly bool
+	var emitSymlinks bool
+	var olderThan string
+	var useATime bool
+	var dirSummary bool
+	var replacePrefixes stringList
+	var stripPrefixPath string
+	var findDangerous bool
+	sensitivePaths := "/etc,/bin,/sbin,/usr,/lib,/lib64,/boot,/root"
+	var printStats bool
+	var outputs stringList
+	var samplePerDir bool
+	var maxPerOwner int
+	var runID string
+	pathMode := "physical"
+	timeField := "mtime"
+	var maxErrors int
+	var useOpenat bool
+	var noCTime bool
+	var intoArchives bool
+	var checkReadable bool
+	var classifyText bool
+	var useEnvelope bool
+	var safe bool
+	var manifestHash bool
+	var fields string
+	var fullMatch bool
+	var hashContent bool
+	var humanSize string
+	var requireResults bool
+	var baseline string
+	var inodeChangedOnly bool
+	var readdirBatch int
+	var externalLinks bool
+	var quiet bool
+	var showConfig bool
+	var checkpointFile string
+	var appendOutput bool
+	var hashList string
+	var hashListOnly bool
+	var sortBy string
+	var externalSort bool
+	sortMem := 256
+	fdLimit := "warn"
+	var oneFS bool
+	var maxDepth int
+	var maxDirs int
+	var workWindow string
+	var skipMarker string
+	conc := 4
+
+	// Parse errors and usage are buffered, as -quiet may come after them.
+	var usage bytes.Buffer
+	flagSet := flag.NewFlagSet("Usage", flag.ContinueOnError)
+	flagSet.SetOutput(&usage)
+	if len(os.Args) > 2 {
+		flagSet.StringVar(&pattern, "regexp", "", "Crawl regexp match")
+		flagSet.IntVar(&conc, "conc", 4, "Concurrency of crawler")
+		flagSet.StringVar(&modifiedAfter, "modified-after", "", "Only output files modified after this RFC3339 time")
+		flagSet.StringVar(&sinceMarker, "since-marker", "", "Marker file holding the previous crawl start time, used as -modified-after and updated on success")
+		flagSet.IntVar(&largeDirs, "large-dirs", 0, "Only output directories with at least this many entries")
+		flagSet.BoolVar(&caseCollisions, "detect-case-collisions", false, "Only output a record per set of names in a directory that only differ in case")
+		flagSet.BoolVar(&followRootOnly, "follow-root-only", false, "Resolve a symlinked root but do not follow symlinks inside the tree")
+		flagSet.StringVar(&ageBuckets, "age-buckets", "", "Comma separated age bounds for the age_bucket field, e.g. 7d,30d,90d")
+		flagSet.IntVar(&topSize, "top-size", 0, "Only output the N largest files, largest first")
+		flagSet.BoolVar(&timestampAnomaly, "timestamp-anomaly", false, "Mark files with inconsistent atime/mtime/ctime relationships")
+		flagSet.StringVar(&anomalyGap, "anomaly-gap", "365d", "With -timestamp-anomaly, flag files whose mtime is older than their ctime by more than this")
+		flagSet.StringVar(&ionice, "ionice", "", "Lower the crawler's I/O scheduling class: idle or best-effort")
+		flagSet.StringVar(&expectMode, "expect-mode", "", "Only output files whose octal permission bits differ from this, e.g. 0600")
+		flagSet.BoolVar(&namesOnly, "names-only", false, "Only output paths and entry types, skipping all stat calls")
+		flagSet.BoolVar(&emitSymlinks, "emit-symlinks", false, "Output symlink records with link and target metadata instead of following symlinks")
+		flagSet.StringVar(&olderThan, "older-than", "", "Only output files whose -time-field is more than this long ago, e.g. 90d")
+		flagSet.BoolVar(&useATime, "atime", false, "Shorthand for -time-field atime")
+		flagSet.StringVar(&timeField, "time-field", "mtime", "Timestamp the time filters and age buckets use: mtime, atime or ctime")
+		flagSet.BoolVar(&dirSummary, "dir-summary", false, "Also output a record per directory with its own and recursive file count and bytes")
+		flagSet.StringVar(&stripPrefixPath, "strip-prefix", "", "Remove this directory prefix from output paths, e.g. a snapshot's mount point")
+		flagSet.Var(&replacePrefixes, "replace-prefix", "Rewrite output paths starting with old to start with new, given as old=new; may be repeated")
+		flagSet.BoolVar(&findDangerous, "find-dangerous", false, "Only output setuid/setgid files writable by group or others and world writable files in sensitive paths")
+		flagSet.StringVar(&sensitivePaths, "sensitive-paths", "/etc,/bin,/sbin,/usr,/lib,/lib64,/boot,/root", "Comma separated path prefixes where world writable files are flagged by -find-dangerous")
+		flagSet.BoolVar(&printStats, "stats", false, "Print entry, output and per-filter skip counts and per-phase times to stderr when done")
+		flagSet.Var(&outputs, "out", "Write JSON lines to this file, - for stdout; may be repeated to write several outputs at once")
+		flagSet.BoolVar(&appendOutput, "append", false, "Append to -out files instead of truncating them; implied by -checkpoint")
+		flagSet.BoolVar(&samplePerDir, "sample-per-dir", false, "Only output the first matching file in each directory")
+		flagSet.IntVar(&maxPerOwner, "max-per-owner", 0, "Only output the first N files of each owner uid")
+		flagSet.StringVar(&runID, "run-id", "", "Run ID to tag every record with, instead of a generated ULID")
+		flagSet.StringVar(&pathMode, "path-mode", "physical", "Path reported for files reached through symlinks: physical, logical or both")
+		flagSet.IntVar(&maxErrors, "max-errors", 0, "Abort the crawl once this many errors have occurred")
+		flagSet.BoolVar(&useOpenat, "openat", false, "Walk with openat/fstatat relative to directory descriptors, never following symlinks")
+		flagSet.BoolVar(&noCTime, "no-ctime", false, "Leave ctime out of the output")
+		flagSet.BoolVar(&intoArchives, "into-archives", false, "Descend into tar and zip archives and emit their members")
+		flagSet.BoolVar(&checkReadable, "check-readable", false, "Record whether each file can be opened for reading")
+		flagSet.BoolVar(&classifyText, "classify-text", false, "Record whether each file looks like text, from its first 8 KiB")
+		flagSet.BoolVar(&useEnvelope, "envelope", false, "Wrap every JSON record as {\"type\":...,\"data\":...} and append error and summary records")
+		flagSet.BoolVar(&oneFS, "one-fs", false, "Do not descend into directories on other filesystems")
+		flagSet.IntVar(&maxDepth, "max-depth", 0, "Do not descend more than this many levels below the root")
+		flagSet.StringVar(&workWindow, "work-window", "", "Only crawl between these local times each day, pausing outside them, e.g. 01:00-05:00")
+		flagSet.StringVar(&skipMarker, "skip-marker", "", "Do not descend into directories holding an entry with this name, e.g. CACHEDIR.TAG")
+		flagSet.IntVar(&maxDirs, "max-dirs", 0, "Stop descending once this many directories have been queued")
+		flagSet.BoolVar(&safe, "safe", false, fmt.Sprintf("Never follow symlinks or leave the root filesystem, and cap -max-depth at %d and -max-dirs at %d unless given", safeMaxDepth, safeMaxDirs))
+		flagSet.BoolVar(&manifestHash, "manifest-hash", false, "Print an order independent hash over the path, type, size and mtime of all records to stderr when done")
+		flagSet.StringVar(&fields, "fields", "", "Comma separated JSON fields to output, e.g. file_path,size; metadata nothing asks for is not collected")
+		flagSet.StringVar(&fdLimit, "fd-limit", "warn", "What to do when -conc does not fit RLIMIT_NOFILE: warn, clamp or ignore")
+		flagSet.BoolVar(&fullMatch, "full-match", false, "Require -regexp to match the whole path, e.g. '.*/foo\\.txt', not just part of it")
+		flagSet.BoolVar(&hashContent, "hash", false, "Add the SHA-256 of each file's content")
+		flagSet.StringVar(&hashList, "hash-list", "", "File of SHA-256 hashes, one per line; files whose content hash is listed are marked hash_list_match")
+		flagSet.BoolVar(&hashListOnly, "hash-list-only", false, "With -hash-list, only output files whose hash is listed")
+		flagSet.StringVar(&humanSize, "human-size", "", "Add a size_human field in decimal (kB, MB) or binary (KiB, MiB) units")
+		flagSet.BoolVar(&requireResults, "require-results", false, "Exit with status 1 if no records were output")
+		flagSet.StringVar(&baseline, "baseline", "", "Earlier JSON lines output; mark files whose inode differs from the baseline's for the same path as inode_changed")
+		flagSet.BoolVar(&inodeChangedOnly, "inode-changed-only", false, "With -baseline, only output files whose inode changed")
+		flagSet.IntVar(&readdirBatch, "readdir-batch", 0, "Read directories this many entries at a time instead of all at once")
+		flagSet.BoolVar(&externalLinks, "external-links", false, "Mark hardlinked files with links outside the crawled tree with external_links, output once the crawl is done")
+		flagSet.BoolVar(&quiet, "quiet", false, "Write nothing to stderr, including errors, warnings, -stats and -manifest-hash; exit with status 1 if the crawl failed and 2 on invalid flags")
+		flagSet.StringVar(&checkpointFile, "checkpoint", "", "Log finished directories to this file and skip them when the crawl is restarted with it, so no record is output twice; implies -append")
+		flagSet.StringVar(&sortBy, "sort-by", "", "Output all records sorted when done; only size, largest first, is supported")
+		flagSet.BoolVar(&externalSort, "external", false, "With -sort-by, sort in temp file runs of -sort-mem MB instead of in memory")
+		flagSet.IntVar(&sortMem, "sort-mem", 256, "Memory budget in MB per run for -external")
+		flagSet.BoolVar(&showConfig, "print-config", false, "Print the effective configuration, defaults included, as JSON to stderr before crawling")
+		flagSet.StringVar(&depthConc, "depth-conc", "", "Comma separated per-depth concurrency caps as depth:conc, min-max:conc or min+:conc, e.g. 0-1:2,4+:16")
+
+		if err := flagSet.Parse(os.Args[2:]); err != nil {
+			if !quiet {
+				os.Stderr.Write(usage.Bytes())
+			}
+			if err == flag.ErrHelp {
+				os.Exit(0)
+			}
+			os.Exit(2)
 		}
-		return
 	}
 
-	for _, fi := range files {
-		fileName := fi.Name()
-		filePath := path.Join(currPath, fileName)
-		fileMode := fi.Mode()
+	var diag io.Writer = os.Stderr
+	if quiet {
+		diag = ioutil.Discard
+	}
 
-		if pc.followSymlink && (fileMode&os.ModeSymlink == os.ModeSymlink) {
-			newFi, newPath, err := pc.resolveSymlink(currPath, fileName)
-			if err != nil {
-				select {
-				case pc.Error <- err:
-				default:
-				}
-				continue
+	// fail panics like a bad command line always did, or under -quiet
+	// silently exits with status.
+	fail := func(status int, format string, args ...interface{}) {
+		if quiet {
+			os.Exit(status)
+		}
+		panic(fmt.Sprintf(format, args...))
+	}
+
+	if len(strings.TrimSpace(pattern)) > 0 {
+		if _, err := regexp.Compile(pattern); err != nil {
+			fail(2, "invalid -regexp: %v", err)
+		}
+	}
+
+	if fdLimit != "ignore" {
+		if fdLimit != "warn" && fdLimit != "clamp" {
+			fail(2, "invalid -fd-limit: %q", fdLimit)
+		}
+		maxConc, err := fdConcLimit()
+		if err == nil && conc > maxConc {
+			if fdLimit == "clamp" {
+				fmt.Fprintf(diag, "warning: -conc %d exceeds the open file limit, clamping to %d\n", conc, maxConc)
+				conc = maxConc
+			} else {
+				fmt.Fprintf(diag, "warning: -conc %d exceeds the %d the open file limit allows, expect \"too many open files\" errors\n", conc, maxConc)
 			}
+		}
+	}
 
-			fi = newFi
-			fileName = fi.Name()
-			filePath = path.Join(newPath, fileName)
-			fileMode = fi.Mode()
+	if useOpenat {
+		for _, mode := range []struct {
+			flag string
+			set  bool
+		}{
+			{"-large-dirs", largeDirs > 0},
+			{"-dir-summary", dirSummary},
+			{"-names-only", namesOnly},
+			{"-emit-symlinks", emitSymlinks},
+			{"-into-archives", intoArchives},
+			{"-checkpoint", len(checkpointFile) > 0},
+			{"-readdir-batch", readdirBatch > 0},
+		} {
+			if mode.set {
+				fail(2, "invalid -openat: %s is not supported with it", mode.flag)
+			}
 		}
+	}
 
-		if fileMode.IsDir() {
-			pc.wg.Add(1)
-			go func(p string) {
-				pc.concLimit <- false
-				pc.crawlDir(p)
-			}(filePath)
-			continue
+	// External links hold back only some records, so a killed crawl would
+	// output the rest of its logged directories again.
+	if len(checkpointFile) > 0 && externalLinks {
+		fail(2, "invalid -checkpoint: -external-links is not supported with it")
+	}
+
+	if len(ionice) > 0 {
+		if err := setIOPriority(ionice); err != nil {
+			fail(2, "invalid -ionice: %v", err)
 		}
+	}
 
-		if !fileMode.IsRegular() {
-			continue
+	var opts []Option
+	if len(modifiedAfter) > 0 {
+		t, err := time.Parse(time.RFC3339Nano, modifiedAfter)
+		if err != nil {
+			fail(2, "invalid -modified-after: %v", err)
 		}
+		opts = append(opts, WithModifiedAfter(t))
+	}
 
-		if pc.pattern != nil && !pc.pattern.MatchString(filePath) {
-			continue
+	if len(sinceMarker) > 0 {
+		t, err := readMarker(sinceMarker)
+		if err != nil {
+			fail(2, "invalid -since-marker: %v", err)
+		}
+		if !t.IsZero() {
+			opts = append(opts, WithModifiedAfter(t))
 		}
+	}
 
-		stat := fi.Sys().(*syscall.Stat_t)
-		fileSignature := fmt.Sprintf("%s%d%d%d%d", filePath, stat.Ino, stat.Size, stat.Mtim.Sec, stat.Mtim.Nsec)
-		info := &PosixInfo{
-			FilePath: filePath,
-			INode:    stat.Ino,
-			Size:     stat.Size,
-			UID:      stat.Uid,
-			GID:      stat.Gid,
-			MTime:    time.Unix(int64(stat.Mtim.Sec), int64(stat.Mtim.Nsec)).UTC(),
-			CTime:    time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec)).UTC(),
-			ID:       fmt.Sprintf("%x", md5.Sum([]byte(fileSignature))),
+	if largeDirs > 0 {
+		opts = append(opts, WithLargeDirs(largeDirs))
+	}
+
+	if caseCollisions {
+		opts = append(opts, WithCaseCollisions())
+	}
+
+	if followRootOnly {
+		opts = append(opts, WithFollowRootOnly())
+	}
+
+	if len(ageBuckets) > 0 {
+		var bounds []time.Duration
+		for _, bound := range strings.Split(ageBuckets, ",") {
+			d, err := parseAge(bound)
+			if err != nil {
+				fail(2, "invalid -age-buckets: %v", err)
+			}
+			bounds = append(bounds, d)
 		}
-		pc.Outputs <- info
+		opts = append(opts, WithAgeBuckets(bounds...))
 	}
-}
 
-func readDir(path string) ([]os.FileInfo, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+	if topSize > 0 {
+		opts = append(opts, WithTopSize(topSize))
 	}
 
-	list, err := f.Readdir(-1)
-	f.Close()
-	return list, err
-}
+	if timestampAnomaly {
+		gap, err := parseAge(anomalyGap)
+		if err != nil {
+			fail(2, "invalid -anomaly-gap: %v", err)
+		}
+		opts = append(opts, WithTimestampAnomalies(gap))
+	}
 
-func (pc *PosixCrawler) resolveSymlink(currPath string, linkName string) (os.FileInfo, string, error) {
-	filePath := currPath
-	linkName = path.Join(filePath, linkName)
-	fileName, err := os.Readlink(linkName)
-	if err != nil {
-		return nil, "", err
+	if len(expectMode) > 0 {
+		mode, err := strconv.ParseUint(expectMode, 8, 32)
+		if err != nil || mode > permBits {
+			fail(2, "invalid -expect-mode: %q", expectMode)
+		}
+		opts = append(opts, WithExpectMode(uint32(mode)))
 	}
-	if !path.IsAbs(fileName) {
-		fileName = path.Join(filePath, fileName)
-		fileName = filepath.Clean(fileName)
-		filePath = filepath.Dir(fileName)
+
+	if namesOnly {
+		opts = append(opts, WithNamesOnly())
 	}
 
-	isSymlink := true
-	filesSeen := make(map[string]bool)
+	if emitSymlinks {
+		opts = append(opts, WithSymlinkRecords())
+	}
 
-	for {
-		fi, err := os.Lstat(fileName)
+	if len(olderThan) > 0 {
+		age, err := parseAge(olderThan)
 		if err != nil {
-			return nil, "", err
+			fail(2, "invalid -older-than: %v", err)
 		}
+		opts = append(opts, WithOlderThan(age, false))
+	}
 
-		if _, found := filesSeen[fileName]; found {
-			return nil, "", fmt.Errorf("circular symlink: %v", linkName)
+	if dirSummary {
+		opts = append(opts, WithDirSummary())
+	}
+
+	for _, spec := range replacePrefixes {
+		parts := strings.SplitN(spec, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			fail(2, "invalid -replace-prefix: %q", spec)
 		}
-		filesSeen[fileName] = false
+		opts = append(opts, WithPathTransform(replacePrefix(parts[0], parts[1])))
+	}
 
-		isSymlink = fi.Mode()&os.ModeSymlink == os.ModeSymlink
-		if isSymlink {
-			fileName, err = os.Readlink(fileName)
-			if err != nil {
-				return nil, "", err
-			}
-			if !path.IsAbs(fileName) {
-				fileName = path.Join(filePath, fileName)
-				fileName = filepath.Clean(fileName)
-				filePath = filepath.Dir(fileName)
+	if len(stripPrefixPath) > 0 {
+		opts = append(opts, WithStripPrefix(stripPrefixPath))
+	}
+
+	if findDangerous {
+		var sensitive []string
+		for _, prefix := range strings.Split(sensitivePaths, ",") {
+			if prefix = strings.TrimSpace(prefix); len(prefix) > 0 {
+				sensitive = append(sensitive, path.Clean(prefix))
 			}
-			continue
+		}
+		opts = append(opts, WithDangerousOnly(sensitive...))
+	}
+
+	if samplePerDir {
+		opts = append(opts, WithSamplePerDir())
+	}
+
+	if maxPerOwner > 0 {
+		opts = append(opts, WithMaxPerOwner(maxPerOwner))
+	}
+
+	if len(runID) > 0 {
+		opts = append(opts, WithRunID(runID))
+	}
+
+	switch pathMode {
+	case "physical":
+	case "logical":
+		opts = append(opts, WithPathMode(PathLogical))
+	case "both":
+		opts = append(opts, WithPathMode(PathBoth))
+	default:
+		fail(2, "invalid -path-mode: %q", pathMode)
+	}
+
+	if useATime {
+		timeField = "atime"
+	}
+	switch timeField {
+	case "mtime":
+	case "atime":
+		opts = append(opts, WithTimeField(TimeATime))
+	case "ctime":
+		opts = append(opts, WithTimeField(TimeCTime))
+	default:
+		fail(2, "invalid -time-field: %q", timeField)
+	}
+
+	if noCTime {
+		opts = append(opts, WithoutCTime())
+	}
+
+	if intoArchives {
+		opts = append(opts, WithArchives())
+	}
+
+	if checkReadable {
+		opts = append(opts, WithReadableCheck())
+	}
+
+	if classifyText {
+		opts = append(opts, WithTextClassification())
+	}
+
+	if useEnvelope {
+		opts = append(opts, WithEnvelope())
+	}
+
+	if oneFS {
+		opts = append(opts, WithOneFilesystem())
+	}
+
+	if maxDepth > 0 {
+		opts = append(opts, WithMaxDepth(maxDepth))
+	}
+
+	if len(workWindow) > 0 {
+		start, end, err := parseWorkWindow(workWindow)
+		if err != nil {
+			fail(2, "invalid -work-window: %v", err)
+		}
+		opts = append(opts, WithWorkWindow(start, end))
+	}
+
+	if len(skipMarker) > 0 {
+		opts = append(opts, WithSkipMarker(skipMarker))
+	}
+
+	if maxDirs > 0 {
+		opts = append(opts, WithMaxDirs(maxDirs))
+	}
+
+	if safe {
+		opts = append(opts, WithSafeMode())
+	}
+
+	if manifestHash {
+		opts = append(opts, WithManifestHash())
+	}
+
+	if len(fields) > 0 {
+		if err := checkFields(strings.Split(fields, ",")); err != nil {
+			fail(2, "invalid -fields: %v", err)
+		}
+		opts = append(opts, WithFields(strings.Split(fields, ",")...))
+	}
+
+	if fullMatch {
+		opts = append(opts, WithFullMatch())
+	}
+
+	if hashContent {
+		opts = append(opts, WithContentHash())
+	}
+
+	if len(baseline) > 0 {
+		inodes, err := loadBaseline(baseline)
+		if err != nil {
+			fail(2, "invalid -baseline: %v", err)
+		}
+		opts = append(opts, WithBaseline(inodes, inodeChangedOnly))
+	}
+
+	if readdirBatch > 0 {
+		opts = append(opts, WithReaddirBatch(readdirBatch))
+	}
+
+	if len(checkpointFile) > 0 {
+		opts = append(opts, WithCheckpoint(checkpointFile))
+	}
+
+	if externalLinks {
+		opts = append(opts, WithExternalLinks())
+	}
+
+	if requireResults {
+		opts = append(opts, WithRequireResults())
+	}
+
+	switch humanSize {
+	case "":
+	case "decimal":
+		opts = append(opts, WithHumanSizes(false))
+	case "binary":
+		opts = append(opts, WithHumanSizes(true))
+	default:
+		fail(2, "invalid -human-size: %q", humanSize)
+	}
+
+	if len(hashList) > 0 {
+		hashes, err := loadHashList(hashList)
+		if err != nil {
+			fail(2, "invalid -hash-list: %v", err)
+		}
+		opts = append(opts, WithHashList(hashes, hashListOnly))
+	}
+
+	if printStats {
+		opts = append(opts, WithPhaseTiming())
+	}
+
+	switch sortBy {
+	case "":
+	case "size":
+		if externalSort {
+			opts = append(opts, WithExternalSort(int64(sortMem)<<20))
 		} else {
-			return fi, filePath, nil
+			opts = append(opts, WithSortBySize())
 		}
+	default:
+		fail(2, "invalid -sort-by: %q", sortBy)
 	}
 
-}
+	if maxErrors > 0 {
+		opts = append(opts, WithMaxErrors(maxErrors))
+	}
 
-func (pc *PosixCrawler) outputResult() {
-	for info := range pc.Outputs {
-		out, _ := json.Marshal(info)
-		fmt.Printf("%s\n", string(out))
+	if len(depthConc) > 0 {
+		for _, spec := range strings.Split(depthConc, ",") {
+			minDepth, maxDepth, limit, err := parseDepthLimit(spec)
+			if err != nil {
+				fail(2, "invalid -depth-conc: %v", err)
+			}
+			opts = append(opts, WithDepthLimit(minDepth, maxDepth, limit))
+		}
 	}
-}
 
-func main() {
-	if len(os.Args) < 2 {
-		panic("please specify root directory to crawl")
+	// A restarted checkpointed crawl only emits what the earlier runs did
+	// not, so their output must be kept.
+	if len(checkpointFile) > 0 {
+		appendOutput = true
 	}
+	outputFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appendOutput {
+		outputFlags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	var outputFiles []*bufio.Writer
+	for _, output := range outputs {
+		if output == "-" {
+			opts = append(opts, WithOutput(os.Stdout))
+			continue
+		}
 
-	rootDir := os.Args[1]
-	var pattern string
-	conc := 4
+		f, err := os.OpenFile(output, outputFlags, 0666)
+		if err != nil {
+			fail(2, "invalid -out: %v", err)
+		}
+		defer f.Close()
 
-	if len(os.Args) > 2 {
-		flagSet := flag.NewFlagSet("Usage", flag.ExitOnError)
-		flagSet.StringVar(&pattern, "regexp", "", "Crawl regexp match")
-		flagSet.IntVar(&conc, "conc", 4, "Concurrency of crawler")
+		w := bufio.NewWriter(f)
+		outputFiles = append(outputFiles, w)
+		opts = append(opts, WithOutput(w))
+	}
 
-		flagSet.Parse(os.Args[2:])
+	startTime := time.Now()
+	crawler := NewPosixCrawler(conc, pattern, true, opts...)
+	if showConfig {
+		printConfig(diag, flagSet, crawler, rootDir)
+	}
+	var err error
+	if useOpenat {
+		fd, openErr := syscall.Open(rootDir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+		if openErr != nil {
+			fail(1, "can not open %v: %v", rootDir, openErr)
+		}
+		err = crawler.CrawlFd(fd, rootDir)
+		syscall.Close(fd)
+	} else {
+		err = crawler.Crawl(rootDir)
+	}
+	for _, w := range outputFiles {
+		if flushErr := w.Flush(); flushErr != nil {
+			fmt.Fprintln(diag, flushErr)
+		}
+	}
+	if printStats {
+		crawler.PrintStats(diag)
+	}
+	if manifestHash {
+		fmt.Fprintf(diag, "manifest hash: %s\n", crawler.ManifestHash())
 	}
-	crawler := NewPosixCrawler(conc, pattern, true)
-	err := crawler.Crawl(rootDir)
 	if err != nil {
-		os.Stderr.Write([]byte(err.Error() + "\n"))
+		fmt.Fprintln(diag, err)
+		// Under -quiet the exit status is all that tells a failed crawl
+		// from a successful one.
+		if quiet || errors.Is(err, ErrNoResults) {
+			os.Exit(1)
+		}
+	} else if len(sinceMarker) > 0 {
+		if err := writeMarker(sinceMarker, startTime); err != nil {
+			fmt.Fprintln(diag, err)
+		}
 	}
 }
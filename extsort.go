@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// sortFanIn caps how many runs are merged at once, and so how many temp
+// files are open, well below the usual 1024 open file limit.
+const sortFanIn = 64
+
+// sortEntry keeps a record encoded when it may be spilled, so the run size
+// in memory is close to the bytes it takes on disk. Records sorted in
+// memory only are kept as they are.
+type sortEntry struct {
+	size int64
+	path string
+	line []byte
+	info *PosixInfo
+}
+
+func sortEntryLess(a *sortEntry, b *sortEntry) bool {
+	if a.size != b.size {
+		return a.size > b.size
+	}
+	return a.path < b.path
+}
+
+// sortRun is a sorted run spilled to a temp file, which is only open while
+// the run is being merged.
+type sortRun struct {
+	name string
+	f    *os.File
+	r    *bufio.Reader
+	head *sortEntry
+}
+
+func (run *sortRun) open() error {
+	f, err := os.Open(run.name)
+	if err != nil {
+		return err
+	}
+	run.f, run.r = f, bufio.NewReader(f)
+	return run.next()
+}
+
+func (run *sortRun) close() {
+	if run.f != nil {
+		run.f.Close()
+		run.f, run.r = nil, nil
+	}
+}
+
+func (run *sortRun) next() error {
+	line, err := run.r.ReadBytes('\n')
+	if err != nil {
+		run.head = nil
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	var key struct {
+		FilePath string `json:"file_path"`
+		Size     int64  `json:"size"`
+	}
+	if err := json.Unmarshal(line, &key); err != nil {
+		run.head = nil
+		return err
+	}
+	run.head = &sortEntry{size: key.Size, path: key.FilePath, line: line}
+	return nil
+}
+
+type runHeap []*sortRun
+
+func (h runHeap) Len() int            { return len(h) }
+func (h runHeap) Less(i, j int) bool  { return sortEntryLess(h[i].head, h[j].head) }
+func (h runHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *runHeap) Push(x interface{}) { *h = append(*h, x.(*sortRun)) }
+
+func (h *runHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// outputSorted writes all records largest first. With an external sort
+// budget, records are sorted in runs of about that many bytes which are
+// spilled to temp files, merged sortFanIn at a time until few enough are
+// left, and k-way merged at the end. A run that can not be spilled stays
+// in memory, so a full disk costs memory but not records.
+func (pc *PosixCrawler) outputSorted() {
+	var runs []*sortRun
+	defer func() {
+		for _, run := range runs {
+			run.close()
+			os.Remove(run.name)
+		}
+	}()
+
+	var pending []*sortEntry
+	var pendingBytes int64
+	spill := pc.sortBudget > 0
+	for info := range pc.Outputs {
+		if info.commit != nil {
+			pc.commitDir(info)
+			continue
+		}
+		if !spill {
+			pending = append(pending, &sortEntry{size: info.Size, path: info.FilePath, info: info})
+			continue
+		}
+
+		line, _ := json.Marshal(info)
+		pending = append(pending, &sortEntry{size: info.Size, path: info.FilePath, line: append(line, '\n')})
+		pendingBytes += int64(len(line))
+		if pendingBytes >= pc.sortBudget {
+			run, err := writeSortRun(pending)
+			if err != nil {
+				pc.reportError(newCrawlError("sort", os.TempDir(), err))
+				spill = false
+				continue
+			}
+			runs = append(runs, run)
+			pending, pendingBytes = nil, 0
+		}
+	}
+
+	for len(runs) > sortFanIn {
+		run, err := pc.mergeRuns(runs[:sortFanIn])
+		if err != nil {
+			pc.reportError(newCrawlError("sort", os.TempDir(), err))
+			break
+		}
+		for _, merged := range runs[:sortFanIn] {
+			os.Remove(merged.name)
+		}
+		runs = append(runs[sortFanIn:], run)
+	}
+
+	sort.Slice(pending, func(i, j int) bool { return sortEntryLess(pending[i], pending[j]) })
+	pc.merge(runs, pending, pc.writeSorted)
+}
+
+// mergeRuns merges runs into a new run, leaving the old ones to be removed
+// by the caller.
+func (pc *PosixCrawler) mergeRuns(runs []*sortRun) (*sortRun, error) {
+	f, err := ioutil.TempFile("", "crawler-run-")
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	pc.merge(runs, nil, func(entry *sortEntry) {
+		if err == nil {
+			_, err = w.Write(entry.line)
+		}
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &sortRun{name: f.Name()}, nil
+}
+
+// merge hands fn the entries of runs and of the sorted pending entries in
+// order. Runs that fail to read are reported and end early.
+func (pc *PosixCrawler) merge(runs []*sortRun, pending []*sortEntry, fn func(*sortEntry)) {
+	merged := &runHeap{}
+	for _, run := range runs {
+		if err := run.open(); err != nil {
+			pc.reportError(newCrawlError("sort", run.name, err))
+		}
+		if run.head != nil {
+			heap.Push(merged, run)
+		} else {
+			run.close()
+		}
+	}
+
+	for merged.Len() > 0 || len(pending) > 0 {
+		if merged.Len() == 0 || len(pending) > 0 && sortEntryLess(pending[0], (*merged)[0].head) {
+			fn(pending[0])
+			pending = pending[1:]
+			continue
+		}
+
+		run := (*merged)[0]
+		fn(run.head)
+		if err := run.next(); err != nil {
+			pc.reportError(newCrawlError("sort", run.name, err))
+		}
+		if run.head == nil {
+			run.close()
+			heap.Pop(merged)
+		} else {
+			heap.Fix(merged, 0)
+		}
+	}
+}
+
+func (pc *PosixCrawler) writeSorted(entry *sortEntry) {
+	if entry.info != nil {
+		pc.writeInfo(entry.info)
+		return
+	}
+
+	info := &PosixInfo{}
+	if err := json.Unmarshal(entry.line, info); err != nil {
+		pc.reportError(newCrawlError("sort", entry.path, err))
+		return
+	}
+	pc.writeInfo(info)
+}
+
+// writeSortRun sorts entries and writes them to a closed temp file.
+func writeSortRun(entries []*sortEntry) (*sortRun, error) {
+	sort.Slice(entries, func(i, j int) bool { return sortEntryLess(entries[i], entries[j]) })
+
+	f, err := ioutil.TempFile("", "crawler-run-")
+	if err != nil {
+		return nil, err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, entry := range entries {
+		if _, err = w.Write(entry.line); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+
+	return &sortRun{name: f.Name()}, nil
+}
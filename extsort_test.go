@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSortBySize(t *testing.T) {
+	root, err := ioutil.TempDir("", "extsort")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	// More files than sortFanIn, so a budget of one byte spills every
+	// record to its own run and takes more than one merge pass.
+	n := 2*sortFanIn + 10
+	for i := 0; i < n; i++ {
+		data := make([]byte, (i*37)%n)
+		if err := ioutil.WriteFile(filepath.Join(root, fmt.Sprintf("f%03d", i)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for name, opt := range map[string]Option{"memory": WithSortBySize(), "external": WithExternalSort(1)} {
+		var sizes []int64
+		for _, info := range crawlRecords(t, root, opt) {
+			sizes = append(sizes, info.Size)
+		}
+		if len(sizes) != n {
+			t.Errorf("%s: got %d records, want %d", name, len(sizes), n)
+			continue
+		}
+		for i := 1; i < len(sizes); i++ {
+			if sizes[i] > sizes[i-1] {
+				t.Errorf("%s: record %d has size %d after %d", name, i, sizes[i], sizes[i-1])
+				break
+			}
+		}
+	}
+}
+
+func TestSortRunMerge(t *testing.T) {
+	pc := NewPosixCrawler(1, "", false)
+	var runs []*sortRun
+	defer func() {
+		for _, run := range runs {
+			os.Remove(run.name)
+		}
+	}()
+	for _, sizes := range [][]int64{{3, 9, 1}, {7, 2}, {}, {8, 8}} {
+		var entries []*sortEntry
+		for i, size := range sizes {
+			entry := &sortEntry{size: size, path: fmt.Sprintf("p%d", i)}
+			entry.line = []byte(fmt.Sprintf("{\"file_path\":%q,\"size\":%d}\n", entry.path, size))
+			entries = append(entries, entry)
+		}
+		run, err := writeSortRun(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runs = append(runs, run)
+	}
+
+	merged, err := pc.mergeRuns(runs[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs = append(runs, merged)
+
+	var got []string
+	pending := []*sortEntry{{size: 5, path: "q"}}
+	pc.merge([]*sortRun{merged, runs[2], runs[3]}, pending, func(entry *sortEntry) {
+		got = append(got, fmt.Sprintf("%d:%s", entry.size, entry.path))
+	})
+	want := fmt.Sprint([]string{"9:p1", "8:p0", "8:p1", "7:p0", "5:q", "3:p0", "2:p1", "1:p2"})
+	if fmt.Sprint(got) != want {
+		t.Errorf("merged %v, want %v", got, want)
+	}
+}
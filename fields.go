@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+type projectedField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// statFields are the PosixInfo fields that can only be filled in from a
+// stat of the file.
+var statFields = []string{
+	"dev", "inode", "nlink", "mode", "size", "size_human", "uid", "gid", "mtime", "ctime", "atime", "file_id",
+	"age_bucket", "time_anomalies", "risks", "summary", "inode_changed", "external_links",
+}
+
+// projectFields maps JSON field names to PosixInfo fields, in the order
+// they are declared, and panics on an unknown name.
+func projectFields(names []string) ([]projectedField, map[string]bool) {
+	wanted := make(map[string]bool)
+	for _, name := range names {
+		wanted[strings.TrimSpace(name)] = true
+	}
+
+	var fields []projectedField
+	found := make(map[string]bool)
+	t := reflect.TypeOf(PosixInfo{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")
+		if !wanted[tag[0]] || len(t.Field(i).PkgPath) > 0 {
+			continue
+		}
+		found[tag[0]] = true
+		fields = append(fields, projectedField{
+			name:      tag[0],
+			index:     i,
+			omitEmpty: len(tag) > 1 && tag[1] == "omitempty",
+		})
+	}
+
+	for name := range wanted {
+		if !found[name] {
+			panic(fmt.Sprintf("unknown field %q", name))
+		}
+	}
+	return fields, wanted
+}
+
+// checkFields returns an error for the first of names that is not a
+// PosixInfo JSON field, which WithFields would panic on.
+func checkFields(names []string) error {
+	known := make(map[string]bool)
+	t := reflect.TypeOf(PosixInfo{})
+	for i := 0; i < t.NumField(); i++ {
+		if len(t.Field(i).PkgPath) == 0 {
+			known[strings.Split(t.Field(i).Tag.Get("json"), ",")[0]] = true
+		}
+	}
+
+	for _, name := range names {
+		if name = strings.TrimSpace(name); !known[name] {
+			return fmt.Errorf("unknown field %q", name)
+		}
+	}
+	return nil
+}
+
+// wants reports whether the field is emitted, which is always the case
+// without WithFields.
+func (pc *PosixCrawler) wants(name string) bool {
+	return pc.fields == nil || pc.fields[name]
+}
+
+// needsStat reports whether any emitted field or active filter depends on
+// a stat of each file.
+func (pc *PosixCrawler) needsStat() bool {
+	if pc.checkMode || pc.dangerousOnly || !pc.modifiedAfter.IsZero() || pc.olderThan > 0 ||
+		pc.topSize > 0 || pc.sortBySize || pc.dirSummary || pc.anomalies || len(pc.ageBuckets) > 0 || pc.manifestHash || pc.baseline != nil || pc.linkScope ||
+		pc.maxPerOwner > 0 {
+		return true
+	}
+	for _, name := range statFields {
+		if pc.wants(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (pc *PosixCrawler) project(info *PosixInfo) json.RawMessage {
+	v := reflect.ValueOf(info).Elem()
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for _, field := range pc.projection {
+		value := v.Field(field.index)
+		if field.omitEmpty && (value.IsZero() || value.Kind() == reflect.Slice && value.Len() == 0) {
+			continue
+		}
+		out, _ := json.Marshal(value.Interface())
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, "%q:", field.name)
+		buf.Write(out)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes()
+}
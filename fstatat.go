@@ -0,0 +1,9 @@
+//go:build arm64 || riscv64 || mips64 || mips64le || loong64
+
+package main
+
+import "syscall"
+
+func fstatat(dirfd int, name string, stat *syscall.Stat_t, flags int) error {
+	return syscall.Fstatat(dirfd, name, stat, flags)
+}
@@ -0,0 +1,7 @@
+//go:build 386 || arm || mips || mipsle
+
+package main
+
+import "syscall"
+
+const sysFstatat = syscall.SYS_FSTATAT64
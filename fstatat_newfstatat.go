@@ -0,0 +1,7 @@
+//go:build amd64 || ppc64 || ppc64le || s390x
+
+package main
+
+import "syscall"
+
+const sysFstatat = syscall.SYS_NEWFSTATAT
@@ -0,0 +1,23 @@
+//go:build amd64 || ppc64 || ppc64le || s390x || 386 || arm || mips || mipsle
+
+package main
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// fstatat is missing from syscall on these architectures, so it is called
+// directly, as newfstatat or, where Stat_t is struct stat64, fstatat64.
+func fstatat(dirfd int, name string, stat *syscall.Stat_t, flags int) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall6(sysFstatat, uintptr(dirfd), uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(stat)), uintptr(flags), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
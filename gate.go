@@ -0,0 +1,70 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// gate holds back the goroutines of one pipeline stage while paused.
+type gate struct {
+	paused int32
+	mu     sync.Mutex
+	resume chan bool
+}
+
+func (g *gate) pause() {
+	g.mu.Lock()
+	if g.resume == nil {
+		g.resume = make(chan bool)
+		atomic.StoreInt32(&g.paused, 1)
+	}
+	g.mu.Unlock()
+}
+
+func (g *gate) unpause() {
+	g.mu.Lock()
+	if g.resume != nil {
+		atomic.StoreInt32(&g.paused, 0)
+		close(g.resume)
+		g.resume = nil
+	}
+	g.mu.Unlock()
+}
+
+// wait returns once the gate is open or quit is closed.
+func (g *gate) wait(quit chan bool) {
+	if atomic.LoadInt32(&g.paused) == 0 {
+		return
+	}
+
+	g.mu.Lock()
+	resume := g.resume
+	g.mu.Unlock()
+	if resume == nil {
+		return
+	}
+	select {
+	case <-resume:
+	case <-quit:
+	}
+}
+
+// PauseDiscovery stops workers from reading further directory entries
+// while records already found keep draining to the sinks.
+func (pc *PosixCrawler) PauseDiscovery() {
+	pc.discovery.pause()
+}
+
+func (pc *PosixCrawler) ResumeDiscovery() {
+	pc.discovery.unpause()
+}
+
+// PauseOutput stops records from reaching the sinks. Discovery keeps going
+// until the Outputs buffer is full.
+func (pc *PosixCrawler) PauseOutput() {
+	pc.output.pause()
+}
+
+func (pc *PosixCrawler) ResumeOutput() {
+	pc.output.unpause()
+}
@@ -0,0 +1,46 @@
+package main
+
+import "syscall"
+
+type inodeKey struct {
+	dev uint64
+	ino uint64
+}
+
+// noteLink records every path a hardlinked regular file was found under.
+// Workers call it right after the stat, before any filter, so links whose
+// records are never emitted still count as inside the tree. The counts are
+// only read by the output stage once all workers are done.
+func (pc *PosixCrawler) noteLink(filePath string, stat *syscall.Stat_t) {
+	if stat.Nlink <= 1 {
+		return
+	}
+
+	key := inodeKey{dev: uint64(stat.Dev), ino: stat.Ino}
+	pc.linkMu.Lock()
+	defer pc.linkMu.Unlock()
+	if pc.linkPaths == nil {
+		pc.linkPaths = make(map[inodeKey]map[string]bool)
+	}
+	if pc.linkPaths[key] == nil {
+		pc.linkPaths[key] = make(map[string]bool)
+	}
+	pc.linkPaths[key][filePath] = true
+}
+
+func (pc *PosixCrawler) setExternalLinks(info *PosixInfo) {
+	found := len(pc.linkPaths[inodeKey{dev: info.Dev, ino: info.INode}])
+	if external := int64(info.Nlink) - int64(found); external > 0 {
+		info.ExternalLinks = external
+	}
+}
+
+// flushLinks emits the records writeInfo held back until every link was
+// counted.
+func (pc *PosixCrawler) flushLinks() {
+	for _, info := range pc.heldLinks {
+		pc.setExternalLinks(info)
+		pc.sendInfo(info)
+	}
+	pc.heldLinks, pc.linkPaths = nil, nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"path"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+const atSymlinkNofollow = 0x100
+
+// dirHandle is an open directory shared with the tasks of its
+// subdirectories, which open themselves relative to it. The descriptor is
+// closed once the directory's own listing and every child open are done.
+type dirHandle struct {
+	fd    int
+	refs  int32
+	owned bool
+}
+
+func (h *dirHandle) retain() {
+	atomic.AddInt32(&h.refs, 1)
+}
+
+func (h *dirHandle) release() {
+	if atomic.AddInt32(&h.refs, -1) == 0 && h.owned {
+		syscall.Close(h.fd)
+	}
+}
+
+// CrawlFd crawls the already open directory fd. Every entry is stat'ed
+// with fstatat and every subdirectory opened with openat relative to its
+// parent's descriptor, so no path string is ever resolved again and a
+// rename or symlink swap during the crawl can not redirect it. Symlinks
+// are never followed and only regular file records, or with
+// WithCaseCollisions case collision records, are emitted, so the
+// directory, summary, symlink, names-only, archive and checkpoint options
+// have no effect, and directories are always read in full. rootPath is only
+// used to build the output paths, and fd stays owned by the caller.
+func (pc *PosixCrawler) CrawlFd(fd int, rootPath string) error {
+	if pc.oneFS {
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(fd, &stat); err != nil {
+			return CrawlErrors{newCrawlError("stat", rootPath, err)}
+		}
+		pc.rootDev = uint64(stat.Dev)
+	}
+
+	root := &dirHandle{fd: fd, refs: 1}
+	return pc.run(context.Background(), rootPath, func() {
+		pc.crawlDirAt(root, rootPath, 0)
+	})
+}
+
+func (pc *PosixCrawler) crawlDirAt(dir *dirHandle, currPath string, depth int) {
+	defer pc.wg.Done()
+	defer pc.release(depth)
+	defer dir.release()
+	pc.discovery.wait(pc.quit)
+	if pc.cancelled() {
+		return
+	}
+
+	start := pc.phaseStart()
+	names, err := readDirNamesAt(dir.fd)
+	pc.phaseDone(&pc.stats.readDirTime, start)
+	if err != nil {
+		pc.reportError(newCrawlError("readdir", currPath, err))
+		return
+	}
+	atomic.AddInt64(&pc.stats.entries, int64(len(names)))
+	if len(pc.skipMarker) > 0 {
+		for _, name := range names {
+			if name == pc.skipMarker {
+				pc.skip(skipMarker)
+				return
+			}
+		}
+	}
+
+	if pc.caseCollisions {
+		folded := make(map[string][]string)
+		for _, name := range names {
+			key := strings.ToLower(name)
+			folded[key] = append(folded[key], name)
+		}
+		defer pc.emitCollisions(&dirTask{path: currPath, logical: currPath}, nil, folded)
+	}
+
+	sampled := false
+	for _, name := range names {
+		pc.discovery.wait(pc.quit)
+		if pc.cancelled() {
+			return
+		}
+
+		filePath := path.Join(currPath, name)
+		var stat syscall.Stat_t
+		start := pc.phaseStart()
+		err := fstatat(dir.fd, name, &stat, atSymlinkNofollow)
+		pc.phaseDone(&pc.stats.statTime, start)
+		if err != nil {
+			pc.reportError(newCrawlError("fstatat", filePath, err))
+			continue
+		}
+
+		switch stat.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			if !pc.descend(&stat, depth+1) {
+				continue
+			}
+			pc.spawnDirAt(dir, name, filePath, stat, depth+1)
+		case syscall.S_IFREG:
+			if pc.linkScope {
+				pc.noteLink(filePath, &stat)
+			}
+			if pc.caseCollisions {
+				continue
+			}
+			if pc.pattern != nil && !pc.pattern.MatchString(filePath) {
+				pc.skip(skipRegexp)
+				continue
+			}
+			pc.processFile(filePath, filePath, &stat, nil, &sampled)
+		}
+	}
+}
+
+// spawnDirAt opens the subdirectory from its own worker. The parent handle
+// is retained until then, and the opened directory must still be the one
+// fstatat saw or it is skipped.
+func (pc *PosixCrawler) spawnDirAt(parent *dirHandle, name string, dirPath string, seen syscall.Stat_t, depth int) {
+	parent.retain()
+	pc.wg.Add(1)
+	go func() {
+		pc.acquire(depth)
+		fd, err := syscall.Openat(parent.fd, name, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, 0)
+		parent.release()
+		if err != nil {
+			pc.reportError(newCrawlError("openat", dirPath, err))
+			pc.release(depth)
+			pc.wg.Done()
+			return
+		}
+
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(fd, &stat); err != nil || stat.Dev != seen.Dev || stat.Ino != seen.Ino {
+			if err == nil {
+				err = syscall.ESTALE
+			}
+			syscall.Close(fd)
+			pc.reportError(newCrawlError("openat", dirPath, err))
+			pc.release(depth)
+			pc.wg.Done()
+			return
+		}
+
+		pc.crawlDirAt(&dirHandle{fd: fd, refs: 1, owned: true}, dirPath, depth)
+	}()
+}
+
+func readDirNamesAt(fd int) ([]string, error) {
+	if _, err := syscall.Seek(fd, 0, 0); err != nil {
+		return nil, err
+	}
+
+	var names []string
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := syscall.ReadDirent(fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n <= 0 {
+			return names, nil
+		}
+		_, _, names = syscall.ParseDirent(buf[:n], -1, names)
+	}
+}
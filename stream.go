@@ -0,0 +1,35 @@
+package main
+
+import "context"
+
+// Stream crawls root in the background and returns its records, which are
+// delivered instead of being written to stdout. The records channel is
+// closed once the crawl is done, after which errs receives the crawl's
+// CrawlErrors, if any, and is closed too. Cancelling ctx stops the crawl
+// like WithMaxErrors does and drops the records not yet received, so the
+// caller may stop reading at any point. The crawler may be used again
+// once errs is closed.
+func (pc *PosixCrawler) Stream(ctx context.Context, root string) (<-chan *PosixInfo, <-chan error) {
+	records := make(chan *PosixInfo)
+	errs := make(chan error, 1)
+
+	sinks := pc.sinks
+	pc.sinks = append(sinks[:len(sinks):len(sinks)], SinkFunc(func(info *PosixInfo) error {
+		select {
+		case records <- info:
+		case <-ctx.Done():
+		}
+		return nil
+	}))
+
+	go func() {
+		err := pc.crawl(ctx, root)
+		pc.sinks = sinks
+		close(records)
+		if err != nil {
+			errs <- err
+		}
+		close(errs)
+	}()
+	return records, errs
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// textSample is how much of the start of a file classifyText looks at.
+const textSample = 8 << 10
+
+type textJob struct {
+	filePath string
+	info     *PosixInfo
+}
+
+// startTextReaders starts n goroutines that classify queued files and emit
+// them, so directory workers only wait on file reads once the queue is
+// full. Every queued job holds a pc.wg count until its record is sent.
+func (pc *PosixCrawler) startTextReaders(n int) {
+	pc.textQueue = make(chan textJob, 4096)
+	for i := 0; i < n; i++ {
+		go func(queue chan textJob) {
+			for job := range queue {
+				pc.setText(job.filePath, job.info)
+				pc.Outputs <- job.info
+				pc.wg.Done()
+			}
+		}(pc.textQueue)
+	}
+}
+
+func (pc *PosixCrawler) setText(filePath string, info *PosixInfo) {
+	isText, err := classifyText(filePath)
+	if err != nil {
+		pc.reportError(newCrawlError("read", filePath, err))
+		return
+	}
+	info.IsText = &isText
+}
+
+// classifyText guesses whether a file holds text from its first
+// textSample bytes: a NUL byte means binary, otherwise at least 95% of the
+// characters must be printable, whitespace or valid UTF-8. Empty files
+// count as text.
+func classifyText(filePath string) (bool, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	buf := make([]byte, textSample)
+	n, err := io.ReadFull(f, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	buf = buf[:n]
+
+	chars, printable := 0, 0
+	for len(buf) > 0 {
+		r, size := utf8.DecodeRune(buf)
+		switch {
+		case r == 0:
+			return false, nil
+		case r == utf8.RuneError && size == 1:
+			// A multi-byte character cut off by the end of the sample
+			// is not held against the file.
+			if n == textSample && len(buf) < utf8.UTFMax && !utf8.FullRune(buf) {
+				buf = nil
+				continue
+			}
+		case r >= 0x20 && r != 0x7f, r == '\t', r == '\n', r == '\r', r == '\f', r == '\v', r == '\b':
+			printable++
+		}
+		chars++
+		buf = buf[size:]
+	}
+	return chars == 0 || printable*100 >= chars*95, nil
+}
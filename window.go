@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// windowRecheck caps how long the scheduler sleeps, so a wall clock that
+// jumps, e.g. at a DST change, is noticed soon.
+const windowRecheck = time.Minute
+
+// parseWorkWindow parses a daily window given as HH:MM-HH:MM in local
+// time. The end may be before the start for a window spanning midnight.
+func parseWorkWindow(s string) (time.Duration, time.Duration, error) {
+	clocks := strings.Split(s, "-")
+	if len(clocks) != 2 {
+		return 0, 0, fmt.Errorf("%q is not HH:MM-HH:MM", s)
+	}
+
+	var bounds [2]time.Duration
+	for i, clock := range clocks {
+		t, err := time.Parse("15:04", strings.TrimSpace(clock))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q is not HH:MM-HH:MM", s)
+		}
+		bounds[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if bounds[0] == bounds[1] {
+		return 0, 0, fmt.Errorf("%q is an empty window", s)
+	}
+	return bounds[0], bounds[1], nil
+}
+
+// inWindow reports whether now is within the daily window, and when that
+// next changes.
+func (pc *PosixCrawler) inWindow(now time.Time) (bool, time.Time) {
+	// The bounds are wall clock times, which on a DST change day are not
+	// the same as that long after midnight.
+	at := func(day int, clock time.Duration) time.Time {
+		y, m, d := now.Date()
+		hh, mm := int(clock/time.Hour), int(clock%time.Hour/time.Minute)
+		return time.Date(y, m, d+day, hh, mm, 0, 0, now.Location())
+	}
+
+	for _, day := range []int{-1, 0} {
+		start := at(day, pc.windowStart)
+		end := at(day, pc.windowEnd)
+		if pc.windowEnd < pc.windowStart {
+			end = at(day+1, pc.windowEnd)
+		}
+		if !now.Before(start) && now.Before(end) {
+			return true, end
+		}
+	}
+
+	if start := at(0, pc.windowStart); now.Before(start) {
+		return false, start
+	}
+	return false, at(1, pc.windowStart)
+}
+
+// startWindow pauses discovery outside the work window and resumes it
+// inside, from now until the returned stop is called, which leaves
+// discovery running. The first check is made before it returns, so a crawl
+// started outside the window never reads a directory.
+func (pc *PosixCrawler) startWindow() (stop func()) {
+	apply := func() time.Duration {
+		inside, until := pc.inWindow(time.Now())
+		if inside {
+			pc.ResumeDiscovery()
+		} else {
+			pc.PauseDiscovery()
+		}
+		if wait := time.Until(until); wait < windowRecheck {
+			return wait
+		}
+		return windowRecheck
+	}
+
+	quit := make(chan bool)
+	done := make(chan bool)
+	wait := apply()
+	go func() {
+		defer close(done)
+		for {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+				wait = apply()
+			case <-quit:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() {
+		close(quit)
+		<-done
+		pc.ResumeDiscovery()
+	}
+}